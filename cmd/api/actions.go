@@ -0,0 +1,304 @@
+package main
+
+import (
+	"broker/event"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action is something /handle can do. Its payload travels in the envelope field
+// named after the action, e.g. {"action": "mail", "mail": {...}}, and is only
+// decoded once the action is known.
+type Action interface {
+	Name() string
+	Description() string
+	// Fields lists the payload's JSON fields for the discovery endpoint
+	Fields() []string
+	// Decode unmarshals and validates the raw payload
+	Decode(raw json.RawMessage) (any, error)
+	// Handle runs a payload returned by Decode and writes the jsonResponse
+	Handle(w http.ResponseWriter, payload any)
+}
+
+// typedAction adapts a payload type, validator and handler to Action
+type typedAction[T any] struct {
+	name        string
+	description string
+	validate    func(T) error
+	handle      func(w http.ResponseWriter, payload T)
+}
+
+func newAction[T any](name, description string, validate func(T) error, handle func(w http.ResponseWriter, payload T)) Action {
+	return &typedAction[T]{
+		name:        name,
+		description: description,
+		validate:    validate,
+		handle:      handle,
+	}
+}
+
+func (a *typedAction[T]) Name() string {
+	return a.name
+}
+
+func (a *typedAction[T]) Description() string {
+	return a.description
+}
+
+func (a *typedAction[T]) Fields() []string {
+	var payload T
+	return jsonFields(reflect.TypeOf(payload))
+}
+
+func (a *typedAction[T]) Decode(raw json.RawMessage) (any, error) {
+	var payload T
+
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("missing %q payload", a.name)
+	}
+
+	err := json.Unmarshal(raw, &payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %q payload: %w", a.name, err)
+	}
+
+	if a.validate != nil {
+		err = a.validate(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
+
+func (a *typedAction[T]) Handle(w http.ResponseWriter, payload any) {
+	a.handle(w, payload.(T))
+}
+
+func jsonFields(t reflect.Type) []string {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fields = append(fields, name)
+	}
+
+	return fields
+}
+
+type actionRegistry struct {
+	mu       sync.RWMutex
+	actions  map[string]Action
+	policies map[string]actionPolicy
+}
+
+func newActionRegistry() *actionRegistry {
+	return &actionRegistry{
+		actions:  map[string]Action{},
+		policies: defaultActionPolicies(),
+	}
+}
+
+func (reg *actionRegistry) register(action Action) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	return reg.registerLocked(action)
+}
+
+// registerWithPolicy adds an action along with the policy saying who may run it
+func (reg *actionRegistry) registerWithPolicy(action Action, policy actionPolicy) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	err := reg.registerLocked(action)
+	if err != nil {
+		return err
+	}
+
+	reg.policies[action.Name()] = policy
+
+	return nil
+}
+
+func (reg *actionRegistry) registerLocked(action Action) error {
+	name := action.Name()
+	if name == "" || name == "action" {
+		return fmt.Errorf("invalid action name %q", name)
+	}
+
+	if _, exists := reg.actions[name]; exists {
+		return fmt.Errorf("action %q is already registered", name)
+	}
+
+	reg.actions[name] = action
+
+	return nil
+}
+
+func (reg *actionRegistry) lookup(name string) (Action, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	action, ok := reg.actions[name]
+	return action, ok
+}
+
+func (reg *actionRegistry) policy(name string) actionPolicy {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return reg.policies[name]
+}
+
+func (reg *actionRegistry) list() []Action {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	actions := make([]Action, 0, len(reg.actions))
+	for _, action := range reg.actions {
+		actions = append(actions, action)
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Name() < actions[j].Name()
+	})
+
+	return actions
+}
+
+func (app *Config) registerDefaultActions() error {
+	actions := []Action{
+		newAction("auth", "Authenticate a user and start a session", validateAuth, app.authenticate),
+		// app.logItem or app.logItemViaRpc can be swapped in here, but only the queue routes on severity and category
+		newAction("log", "Write an entry to the logger service", validateLog, app.logItemViaQueue),
+		newAction("mail", "Send an email through the mail service", validateMail, app.sendMail),
+	}
+
+	for _, action := range actions {
+		err := app.actions.register(action)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateAuth(a AuthPayload) error {
+	if a.Email == "" || a.Password == "" {
+		return errors.New("email and password are required")
+	}
+
+	return nil
+}
+
+func validateLog(entry LogPayload) error {
+	if entry.Name == "" {
+		return errors.New("log name is required")
+	}
+
+	if entry.Severity != "" && !contains(event.Severities, strings.ToUpper(entry.Severity)) {
+		return fmt.Errorf("log severity must be one of %s", strings.Join(event.Severities, ", "))
+	}
+
+	if entry.Category != "" && (strings.ContainsAny(entry.Category, ".*#") || strings.TrimSpace(entry.Category) != entry.Category) {
+		return errors.New("log category must be a single word without dots or wildcards")
+	}
+
+	return nil
+}
+
+func validateMail(msg MailPayload) error {
+	if msg.To == "" || msg.Subject == "" {
+		return errors.New("mail to and subject are required")
+	}
+
+	if msg.Mode != "" && msg.Mode != "sync" && msg.Mode != "queued" {
+		return errors.New(`mail mode must be "sync" or "queued"`)
+	}
+
+	if msg.SendAt != nil && msg.Delay != "" {
+		return errors.New("mail can have send_at or delay, not both")
+	}
+
+	if msg.Delay != "" {
+		delay, err := time.ParseDuration(msg.Delay)
+		if err != nil || delay <= 0 {
+			return errors.New("mail delay must be a positive duration such as 30m")
+		}
+	}
+
+	return nil
+}
+
+// prepareAction finds the envelope's action and decodes its payload
+func (app *Config) prepareAction(requestPayload RequestPayload) (Action, any, error) {
+	action, ok := app.actions.lookup(requestPayload.Action)
+	if !ok {
+		return nil, nil, errors.New("unknown action")
+	}
+
+	payload, err := action.Decode(requestPayload.Payload)
+	if err != nil {
+		actionMetrics.Add(action.Name()+".invalid", 1)
+		return nil, nil, err
+	}
+
+	return action, payload, nil
+}
+
+type actionDescription struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Public      bool     `json:"public"`
+	Roles       []string `json:"roles,omitempty"`
+	Fields      []string `json:"fields"`
+}
+
+// ListActions is the discovery endpoint for registered actions
+func (app *Config) ListActions(w http.ResponseWriter, r *http.Request) {
+	var descriptions []actionDescription
+
+	for _, action := range app.actions.list() {
+		policy := app.actions.policy(action.Name())
+
+		descriptions = append(descriptions, actionDescription{
+			Name:        action.Name(),
+			Description: action.Description(),
+			Public:      policy.Public,
+			Roles:       policy.Roles,
+			Fields:      action.Fields(),
+		})
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "actions"
+	payloadResponse.Data = descriptions
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const apiKeyPrefix = "bk_"
+
+var errApiKeyNotFound = errors.New("api key not found")
+
+// apiKey is a stored machine credential. Only the SHA-256 of the key is kept,
+// the plain text is shown once when the key is created.
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	UsageCount int64      `json:"usage_count"`
+	Revoked    bool       `json:"revoked"`
+}
+
+type apiKeyView struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	UsageCount int64      `json:"usage_count"`
+	Revoked    bool       `json:"revoked"`
+	Key        string     `json:"key,omitempty"`
+}
+
+type createApiKeyPayload struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in,omitempty"`
+}
+
+// apiKeyStore keeps keys in memory and persists them to a JSON file.
+// Usage counters are flushed periodically rather than on every request.
+type apiKeyStore struct {
+	mu    sync.Mutex
+	path  string
+	keys  map[string]*apiKey
+	dirty bool
+}
+
+func newApiKeyStore(path string) (*apiKeyStore, error) {
+	store := &apiKeyStore{
+		path: path,
+		keys: map[string]*apiKey{},
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []*apiKey
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		store.keys[key.ID] = key
+	}
+
+	return store, nil
+}
+
+func (s *apiKeyStore) create(name string, scopes []string, expiresAt *time.Time) (*apiKey, string, error) {
+	id := randomId(8)
+	plain := apiKeyPrefix + id + "." + randomId(24)
+
+	key := &apiKey{
+		ID:        id,
+		Name:      name,
+		Hash:      hashApiKey(plain),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[id] = key
+
+	return key, plain, s.saveLocked()
+}
+
+func (s *apiKeyStore) list() []apiKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]apiKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys
+}
+
+func (s *apiKeyStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return errApiKeyNotFound
+	}
+
+	key.Revoked = true
+
+	return s.saveLocked()
+}
+
+// authenticate checks a presented key and records the use
+func (s *apiKeyStore) authenticate(plain string) (*apiKey, error) {
+	id, _, found := strings.Cut(strings.TrimPrefix(plain, apiKeyPrefix), ".")
+	if !found || !strings.HasPrefix(plain, apiKeyPrefix) {
+		return nil, errors.New("malformed api key")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashApiKey(plain))) != 1 {
+		return nil, errors.New("invalid api key")
+	}
+
+	if key.Revoked {
+		return nil, errors.New("api key has been revoked")
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, errors.New("api key has expired")
+	}
+
+	key.UsageCount++
+	key.LastUsedAt = &now
+	s.dirty = true
+
+	copied := *key
+	return &copied, nil
+}
+
+// check reports whether the key with id is still usable, without counting it as a use
+func (s *apiKeyStore) check(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return errApiKeyNotFound
+	}
+
+	if key.Revoked {
+		return errors.New("api key has been revoked")
+	}
+
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return errors.New("api key has expired")
+	}
+
+	return nil
+}
+
+// flushEvery writes out usage counters in the background
+func (s *apiKeyStore) flushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mu.Lock()
+		if s.dirty {
+			err := s.saveLocked()
+			if err != nil {
+				log.Println("::apiKeyStore - unable to save keys:", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *apiKeyStore) saveLocked() error {
+	s.dirty = false
+
+	if s.path == "" {
+		return nil
+	}
+
+	keys := make([]*apiKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+
+	data, err := json.MarshalIndent(keys, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, ".api-keys-", data)
+}
+
+func hashApiKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func viewApiKey(key apiKey) apiKeyView {
+	return apiKeyView{
+		ID:         key.ID,
+		Name:       key.Name,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		UsageCount: key.UsageCount,
+		Revoked:    key.Revoked,
+	}
+}
+
+func (app *Config) CreateApiKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload createApiKeyPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if requestPayload.Name == "" || len(requestPayload.Scopes) == 0 {
+		app.errorJson(w, errors.New("name and scopes are required"))
+		return
+	}
+
+	var expiresAt *time.Time
+	if requestPayload.ExpiresIn != "" {
+		ttl, err := time.ParseDuration(requestPayload.ExpiresIn)
+		if err != nil {
+			app.errorJson(w, err)
+			return
+		}
+		expiry := time.Now().Add(ttl)
+		expiresAt = &expiry
+	}
+
+	key, plain, err := app.apiKeys.create(requestPayload.Name, requestPayload.Scopes, expiresAt)
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	view := viewApiKey(*key)
+	view.Key = plain
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "api key created"
+	payloadResponse.Data = view
+
+	app.writeJson(w, http.StatusCreated, payloadResponse)
+}
+
+func (app *Config) ListApiKeys(w http.ResponseWriter, r *http.Request) {
+	keys := app.apiKeys.list()
+
+	views := make([]apiKeyView, 0, len(keys))
+	for _, key := range keys {
+		views = append(views, viewApiKey(key))
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "api keys"
+	payloadResponse.Data = views
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+func (app *Config) RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	err := app.apiKeys.revoke(chi.URLParam(r, "id"))
+	if errors.Is(err, errApiKeyNotFound) {
+		app.errorJson(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "api key revoked"
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	batchBestEffort  = "best_effort"
+	batchStopOnError = "stop_on_error"
+)
+
+type batchSettings struct {
+	MaxItems    int   `json:"max_items"`
+	MaxBytes    int64 `json:"max_bytes"`
+	Concurrency int   `json:"concurrency"`
+}
+
+func (s batchSettings) validate() error {
+	if s.MaxItems <= 0 || s.MaxBytes <= 0 || s.Concurrency <= 0 {
+		return errors.New("batch max_items, max_bytes and concurrency must be positive")
+	}
+
+	return nil
+}
+
+type batchItemResult struct {
+	Index      int           `json:"index"`
+	Action     string        `json:"action"`
+	StatusCode int           `json:"status_code"`
+	Skipped    bool          `json:"skipped,omitempty"`
+	Response   *jsonResponse `json:"response,omitempty"`
+}
+
+// HandleBatch runs an array of RequestPayload with bounded concurrency.
+// ?mode=stop_on_error skips items that have not started once one fails, the default is best_effort.
+func (app *Config) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = batchBestEffort
+	}
+
+	if mode != batchBestEffort && mode != batchStopOnError {
+		app.errorJson(w, fmt.Errorf("mode must be %s or %s", batchBestEffort, batchStopOnError))
+		return
+	}
+
+	var items []RequestPayload
+
+	err := app.readJsonWithLimit(w, r, &items, app.settings.Batch.MaxBytes)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if len(items) == 0 {
+		app.errorJson(w, errors.New("batch is empty"))
+		return
+	}
+
+	if len(items) > app.settings.Batch.MaxItems {
+		app.errorJson(w, fmt.Errorf("batch has %d items, the limit is %d", len(items), app.settings.Batch.MaxItems), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchItemResult, len(items))
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped bool
+	)
+	slots := make(chan struct{}, app.settings.Batch.Concurrency)
+
+	for i, item := range items {
+		slots <- struct{}{}
+
+		mu.Lock()
+		skip := stopped
+		mu.Unlock()
+
+		if skip {
+			<-slots
+			results[i] = batchItemResult{Index: i, Action: item.Action, Skipped: true}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, item RequestPayload) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			results[i] = app.runBatchItem(r, i, item)
+
+			if results[i].StatusCode >= 400 && mode == batchStopOnError {
+				mu.Lock()
+				stopped = true
+				mu.Unlock()
+			}
+		}(i, item)
+	}
+	wg.Wait()
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "batch completed"
+	if stopped {
+		payloadResponse.Message = "batch stopped on error"
+	}
+	payloadResponse.Data = results
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+func (app *Config) runBatchItem(r *http.Request, index int, item RequestPayload) batchItemResult {
+	status, response := app.runActionRecorded(r, item)
+
+	return batchItemResult{
+		Index:      index,
+		Action:     item.Action,
+		StatusCode: status,
+		Response:   &response,
+	}
+}
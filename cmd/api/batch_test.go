@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testPayload struct {
+	Value string `json:"value"`
+}
+
+func newBatchTestApp(t *testing.T, s batchSettings) *Config {
+	t.Helper()
+
+	limiter, err := newRateLimiter(rateLimitSettings{Client: rateLimitRule{Requests: 100, Per: "1s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Config{actions: newActionRegistry(), limiter: limiter}
+	app.settings.Batch = s
+
+	actions := []Action{
+		newAction("ok", "succeeds", nil, func(w http.ResponseWriter, p testPayload) {
+			app.writeJson(w, http.StatusOK, jsonResponse{Message: p.Value})
+		}),
+		newAction("fail", "fails", nil, func(w http.ResponseWriter, p testPayload) {
+			app.errorJson(w, errors.New("upstream failed"), http.StatusBadGateway)
+		}),
+	}
+	for _, action := range actions {
+		if err := app.actions.register(action); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return app
+}
+
+func TestHandleBatch(t *testing.T) {
+	user := &principal{Subject: "alice", Kind: "user", Roles: []string{"user"}}
+
+	tests := []struct {
+		name        string
+		settings    batchSettings
+		query       string
+		body        string
+		wantStatus  int
+		wantCodes   []int
+		wantSkipped []bool
+		wantMessage string
+	}{
+		{
+			name:        "best effort runs everything",
+			settings:    batchSettings{MaxItems: 10, MaxBytes: 1 << 20, Concurrency: 2},
+			body:        `[{"action":"ok","ok":{"value":"a"}},{"action":"fail","fail":{}},{"action":"ok","ok":{"value":"b"}}]`,
+			wantStatus:  http.StatusOK,
+			wantCodes:   []int{200, 502, 200},
+			wantSkipped: []bool{false, false, false},
+			wantMessage: "batch completed",
+		},
+		{
+			name:        "stop on error skips the rest",
+			settings:    batchSettings{MaxItems: 10, MaxBytes: 1 << 20, Concurrency: 1},
+			query:       "?mode=stop_on_error",
+			body:        `[{"action":"ok","ok":{}},{"action":"fail","fail":{}},{"action":"ok","ok":{}},{"action":"ok","ok":{}}]`,
+			wantStatus:  http.StatusOK,
+			wantCodes:   []int{200, 502, 0, 0},
+			wantSkipped: []bool{false, false, true, true},
+			wantMessage: "batch stopped on error",
+		},
+		{
+			name:        "unknown actions fail on their own",
+			settings:    batchSettings{MaxItems: 10, MaxBytes: 1 << 20, Concurrency: 2},
+			body:        `[{"action":"nope"},{"action":"ok","ok":{}}]`,
+			wantStatus:  http.StatusOK,
+			wantCodes:   []int{400, 200},
+			wantSkipped: []bool{false, false},
+			wantMessage: "batch completed",
+		},
+		{
+			name:       "too many items",
+			settings:   batchSettings{MaxItems: 1, MaxBytes: 1 << 20, Concurrency: 1},
+			body:       `[{"action":"ok","ok":{}},{"action":"ok","ok":{}}]`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "too many bytes",
+			settings:   batchSettings{MaxItems: 10, MaxBytes: 16, Concurrency: 1},
+			body:       `[{"action":"ok","ok":{"value":"` + strings.Repeat("x", 32) + `"}}]`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty",
+			settings:   batchSettings{MaxItems: 10, MaxBytes: 1 << 20, Concurrency: 1},
+			body:       `[]`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown mode",
+			settings:   batchSettings{MaxItems: 10, MaxBytes: 1 << 20, Concurrency: 1},
+			query:      "?mode=sometimes",
+			body:       `[{"action":"ok","ok":{}}]`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newBatchTestApp(t, tt.settings)
+
+			r := httptest.NewRequest("POST", "/handle/batch"+tt.query, strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), principalKey, user))
+			w := httptest.NewRecorder()
+
+			app.HandleBatch(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantCodes == nil {
+				return
+			}
+
+			var response struct {
+				Message string            `json:"message"`
+				Data    []batchItemResult `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			if response.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", response.Message, tt.wantMessage)
+			}
+
+			if len(response.Data) != len(tt.wantCodes) {
+				t.Fatalf("got %d results, want %d", len(response.Data), len(tt.wantCodes))
+			}
+
+			for i, result := range response.Data {
+				if result.Index != i || result.StatusCode != tt.wantCodes[i] || result.Skipped != tt.wantSkipped[i] {
+					t.Errorf("result %d = index %d, status %d, skipped %v, want status %d, skipped %v",
+						i, result.Index, result.StatusCode, result.Skipped, tt.wantCodes[i], tt.wantSkipped[i])
+				}
+			}
+		})
+	}
+}
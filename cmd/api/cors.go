@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+type corsSettings struct {
+	// Environment picks the policy to use, BROKER_ENV overrides it
+	Environment  string                     `json:"environment"`
+	Environments map[string]corsEnvironment `json:"environments"`
+}
+
+// corsEnvironment is the default policy for an environment plus overrides keyed by path prefix
+type corsEnvironment struct {
+	corsPolicy
+	Routes map[string]corsPolicy `json:"routes"`
+}
+
+// corsPolicy fields left empty in a route override are inherited from the environment
+type corsPolicy struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials *bool    `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"`
+	RequireHttps     bool     `json:"require_https"`
+}
+
+func defaultCorsSettings() corsSettings {
+	allow, deny := true, false
+
+	return corsSettings{
+		Environment: "development",
+		Environments: map[string]corsEnvironment{
+			"development": {
+				corsPolicy: corsPolicy{
+					AllowedOrigins:   []string{"http://localhost", "http://localhost:*"},
+					AllowCredentials: &allow,
+				},
+				Routes: map[string]corsPolicy{
+					"/ping": {AllowedOrigins: []string{"*"}, AllowCredentials: &deny},
+				},
+			},
+		},
+	}
+}
+
+func (p corsPolicy) merge(override corsPolicy) corsPolicy {
+	merged := p
+
+	if len(override.AllowedOrigins) > 0 {
+		merged.AllowedOrigins = override.AllowedOrigins
+	}
+	if len(override.AllowedMethods) > 0 {
+		merged.AllowedMethods = override.AllowedMethods
+	}
+	if len(override.AllowedHeaders) > 0 {
+		merged.AllowedHeaders = override.AllowedHeaders
+	}
+	if len(override.ExposedHeaders) > 0 {
+		merged.ExposedHeaders = override.ExposedHeaders
+	}
+	if override.AllowCredentials != nil {
+		merged.AllowCredentials = override.AllowCredentials
+	}
+	if override.MaxAge > 0 {
+		merged.MaxAge = override.MaxAge
+	}
+	merged.RequireHttps = merged.RequireHttps || override.RequireHttps
+
+	return merged
+}
+
+// validate rejects policies that would let arbitrary sites make credentialed calls
+func (p corsPolicy) validate() error {
+	if len(p.AllowedOrigins) == 0 {
+		return fmt.Errorf("allowed_origins must be listed explicitly")
+	}
+
+	credentials := p.AllowCredentials != nil && *p.AllowCredentials
+
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if credentials {
+				return fmt.Errorf("origin \"*\" cannot be combined with allow_credentials")
+			}
+			continue
+		}
+
+		u, err := url.Parse(strings.Replace(origin, "*", "0", 1))
+		if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("origin %q must look like scheme://host[:port]", origin)
+		}
+
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return fmt.Errorf("origin %q must use http or https", origin)
+		}
+
+		if p.RequireHttps && u.Scheme != "https" {
+			return fmt.Errorf("origin %q must use https", origin)
+		}
+
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("origin %q can only contain one wildcard", origin)
+		}
+
+		if strings.Contains(origin, "*") {
+			host := strings.TrimPrefix(origin, u.Scheme+"://")
+			anyHost := host == "*"
+			subdomain := strings.HasPrefix(host, "*.") && strings.Count(host, ".") >= 2
+			anyPort := strings.HasSuffix(host, ":*") && !strings.Contains(strings.TrimSuffix(host, ":*"), "*")
+
+			if !anyHost && !subdomain && !anyPort {
+				return fmt.Errorf("origin %q: wildcards are only allowed as *.domain.tld or host:*", origin)
+			}
+
+			if anyHost && credentials {
+				return fmt.Errorf("origin %q matches any site and cannot be combined with allow_credentials", origin)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p corsPolicy) options() cors.Options {
+	options := cors.Options{
+		AllowedOrigins:   p.AllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-API-Key", "Idempotency-Key", "Prefer"},
+		ExposedHeaders:   []string{"Link", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "Location", "Idempotent-Replayed"},
+		AllowCredentials: p.AllowCredentials != nil && *p.AllowCredentials,
+		MaxAge:           300,
+	}
+
+	if len(p.AllowedMethods) > 0 {
+		options.AllowedMethods = p.AllowedMethods
+	}
+	if len(p.AllowedHeaders) > 0 {
+		options.AllowedHeaders = p.AllowedHeaders
+	}
+	if len(p.ExposedHeaders) > 0 {
+		options.ExposedHeaders = p.ExposedHeaders
+	}
+	if p.MaxAge > 0 {
+		options.MaxAge = p.MaxAge
+	}
+
+	return options
+}
+
+type corsRoute struct {
+	prefix  string
+	handler func(http.Handler) http.Handler
+}
+
+// newCorsHandler validates the environment's policies and returns a middleware that
+// applies the override with the longest matching path prefix, or the environment default
+func newCorsHandler(s corsSettings, environment string) (func(http.Handler) http.Handler, error) {
+	if environment == "" {
+		environment = s.Environment
+	}
+
+	env, ok := s.Environments[environment]
+	if !ok {
+		return nil, fmt.Errorf("cors: no policy for environment %q, add one under cors.environments in BROKER_CONFIG", environment)
+	}
+
+	err := env.corsPolicy.validate()
+	if err != nil {
+		return nil, fmt.Errorf("cors %s: %w", environment, err)
+	}
+
+	fallback := cors.Handler(env.corsPolicy.options())
+
+	var routes []corsRoute
+	for prefix, override := range env.Routes {
+		policy := env.corsPolicy.merge(override)
+
+		err := policy.validate()
+		if err != nil {
+			return nil, fmt.Errorf("cors %s %s: %w", environment, prefix, err)
+		}
+
+		routes = append(routes, corsRoute{
+			prefix:  strings.TrimSuffix(prefix, "/"),
+			handler: cors.Handler(policy.options()),
+		})
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+
+	return func(next http.Handler) http.Handler {
+		defaultHandler := fallback(next)
+
+		routeHandlers := make([]http.Handler, len(routes))
+		for i, route := range routes {
+			routeHandlers[i] = route.handler(next)
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i, route := range routes {
+				if r.URL.Path == route.prefix || strings.HasPrefix(r.URL.Path, route.prefix+"/") {
+					routeHandlers[i].ServeHTTP(w, r)
+					return
+				}
+			}
+
+			defaultHandler.ServeHTTP(w, r)
+		})
+	}, nil
+}
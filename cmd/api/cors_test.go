@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorsPolicyValidate(t *testing.T) {
+	allow, deny := true, false
+
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials *bool
+		https       bool
+		wantErr     bool
+	}{
+		{"exact origin", []string{"https://app.example.com"}, &allow, true, false},
+		{"origin with port", []string{"http://localhost:8080"}, &allow, false, false},
+		{"none listed", nil, nil, false, true},
+		{"any origin", []string{"*"}, &deny, false, false},
+		{"any origin with credentials", []string{"*"}, &allow, false, true},
+		{"subdomain wildcard", []string{"https://*.example.com"}, &allow, true, false},
+		{"wildcard on a bare tld", []string{"https://*.com"}, &deny, false, true},
+		{"two wildcards", []string{"https://*.*.example.com"}, &deny, false, true},
+		{"wildcard inside a label", []string{"https://app*.example.com"}, &deny, false, true},
+		{"any port", []string{"http://localhost:*"}, &allow, false, false},
+		{"any host with credentials", []string{"https://*"}, &allow, false, true},
+		{"any host without credentials", []string{"https://*"}, &deny, false, false},
+		{"http when https is required", []string{"http://app.example.com"}, &allow, true, true},
+		{"wildcard http when https is required", []string{"http://*.example.com"}, &allow, true, true},
+		{"other scheme", []string{"ftp://app.example.com"}, &deny, false, true},
+		{"no scheme", []string{"app.example.com"}, &deny, false, true},
+		{"with a path", []string{"https://app.example.com/login"}, &deny, false, true},
+		{"with a query", []string{"https://app.example.com?x=1"}, &deny, false, true},
+		{"one bad origin among good ones", []string{"https://app.example.com", "*"}, &allow, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := corsPolicy{AllowedOrigins: tt.origins, AllowCredentials: tt.credentials, RequireHttps: tt.https}
+
+			err := p.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCorsHandlerRouteOverrides(t *testing.T) {
+	allow, deny := true, false
+
+	s := corsSettings{
+		Environments: map[string]corsEnvironment{
+			"production": {
+				corsPolicy: corsPolicy{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: &allow, RequireHttps: true},
+				Routes: map[string]corsPolicy{
+					"/ping": {AllowedOrigins: []string{"*"}, AllowCredentials: &deny},
+				},
+			},
+		},
+	}
+
+	if _, err := newCorsHandler(s, "staging"); err == nil {
+		t.Error("an environment without a policy should be rejected")
+	}
+
+	handler, err := newCorsHandler(s, "production")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		path, origin string
+		wantAllowed  string
+	}{
+		{"/handle", "https://app.example.com", "https://app.example.com"},
+		{"/handle", "https://evil.example.net", ""},
+		{"/ping", "https://evil.example.net", "*"},
+		{"/pingpong", "https://evil.example.net", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Origin", tt.origin)
+		w := httptest.NewRecorder()
+
+		next.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllowed {
+			t.Errorf("%s from %s: Access-Control-Allow-Origin = %q, want %q", tt.path, tt.origin, got, tt.wantAllowed)
+		}
+	}
+}
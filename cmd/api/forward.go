@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// forwardSettings describes an action that just sends its payload on to an upstream service
+type forwardSettings struct {
+	Name          string          `json:"name"`
+	Description   string          `json:"description"`
+	URL           string          `json:"url"`
+	Method        string          `json:"method"`
+	Timeout       string          `json:"timeout"`
+	SuccessStatus int             `json:"success_status"`
+	Required      []string        `json:"required"`
+	Response      forwardResponse `json:"response"`
+	Public        bool            `json:"public"`
+	Roles         []string        `json:"roles"`
+}
+
+// forwardResponse maps the upstream reply onto the broker's jsonResponse
+type forwardResponse struct {
+	Message string `json:"message"`
+	// DataField picks a field of the upstream JSON body to return as data, "." returns all of it
+	DataField string `json:"data_field"`
+	// Status is the status code the broker answers with, defaulting to the upstream's
+	Status int `json:"status"`
+}
+
+type forwardAction struct {
+	settings forwardSettings
+	timeout  time.Duration
+	app      *Config
+}
+
+func newForwardAction(app *Config, s forwardSettings) (Action, error) {
+	if s.Method == "" {
+		s.Method = "POST"
+	}
+	if s.Timeout == "" {
+		s.Timeout = "10s"
+	}
+	if s.SuccessStatus == 0 {
+		s.SuccessStatus = http.StatusAccepted
+	}
+	if s.Response.Message == "" {
+		s.Response.Message = s.Name + " done"
+	}
+
+	timeout, err := time.ParseDuration(s.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("forward action %q: invalid timeout: %w", s.Name, err)
+	}
+
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("forward action %q: invalid url %q", s.Name, s.URL)
+	}
+
+	fa := &forwardAction{
+		settings: s,
+		timeout:  timeout,
+		app:      app,
+	}
+
+	return newAction(s.Name, s.Description, fa.validate, fa.forward), nil
+}
+
+func (fa *forwardAction) validate(payload map[string]any) error {
+	for _, field := range fa.settings.Required {
+		if value, ok := payload[field]; !ok || value == nil || value == "" {
+			return fmt.Errorf("%s is required", field)
+		}
+	}
+
+	return nil
+}
+
+func (fa *forwardAction) forward(w http.ResponseWriter, payload map[string]any) {
+	app := fa.app
+	name := fa.settings.Name
+
+	log.Printf("::forward - %s to %s %s", name, fa.settings.Method, fa.settings.URL)
+
+	jsonData, _ := json.MarshalIndent(payload, "", "\t")
+
+	ctx, cancel := context.WithTimeout(context.Background(), fa.timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, fa.settings.Method, fa.settings.URL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	defer response.Body.Close()
+
+	log.Printf("::forward - response from %s, Code %d", name, response.StatusCode)
+
+	if response.StatusCode != fa.settings.SuccessStatus {
+		app.errorJson(w, fmt.Errorf("error calling %s service", name))
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = fa.settings.Response.Message
+
+	if fa.settings.Response.DataField != "" {
+		body, err := io.ReadAll(io.LimitReader(response.Body, 1048576))
+		if err != nil {
+			app.errorJson(w, err)
+			return
+		}
+
+		payloadResponse.Data, err = mapResponseData(body, fa.settings.Response.DataField)
+		if err != nil {
+			app.errorJson(w, err)
+			return
+		}
+	}
+
+	status := fa.settings.Response.Status
+	if status == 0 {
+		status = response.StatusCode
+	}
+
+	app.writeJson(w, status, payloadResponse)
+}
+
+func mapResponseData(body []byte, field string) (any, error) {
+	var decoded any
+
+	err := json.Unmarshal(body, &decoded)
+	if err != nil {
+		return nil, errors.New("upstream did not return JSON")
+	}
+
+	if field == "." {
+		return decoded, nil
+	}
+
+	object, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, errors.New("upstream did not return a JSON object")
+	}
+
+	return object[field], nil
+}
+
+// registerForwardActions adds the actions from the forward_actions settings, along with their policies
+func (app *Config) registerForwardActions() error {
+	for _, s := range app.settings.ForwardActions {
+		action, err := newForwardAction(app, s)
+		if err != nil {
+			return err
+		}
+
+		err = app.actions.registerWithPolicy(action, actionPolicy{
+			Public: s.Public,
+			Roles:  s.Roles,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
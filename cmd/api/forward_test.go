@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newForwardTestApp(t *testing.T, forwards ...forwardSettings) *Config {
+	t.Helper()
+
+	limiter, err := newRateLimiter(rateLimitSettings{Client: rateLimitRule{Requests: 100, Per: "1s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Config{actions: newActionRegistry(), limiter: limiter}
+	app.settings.ForwardActions = forwards
+
+	if err := app.registerForwardActions(); err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+func TestForwardAction(t *testing.T) {
+	var received map[string]any
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		_ = json.NewDecoder(r.Body).Decode(&received)
+
+		if received["to"] == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"id":"sms-1","queued":true}`))
+	}))
+	defer upstream.Close()
+
+	app := newForwardTestApp(t, forwardSettings{
+		Name:     "sms",
+		URL:      upstream.URL,
+		Required: []string{"to"},
+		Response: forwardResponse{Message: "sms sent", DataField: "id"},
+		Roles:    []string{"user"},
+	})
+
+	user := &principal{Subject: "alice", Kind: "user", Roles: []string{"user"}}
+	service := &principal{Subject: "svc", Kind: "user", Roles: []string{"service"}}
+
+	tests := []struct {
+		name       string
+		principal  *principal
+		payload    string
+		wantStatus int
+		wantData   any
+	}{
+		{"forwarded", user, `{"to":"+15555550100","body":"hi"}`, http.StatusAccepted, "sms-1"},
+		{"missing a required field", user, `{"body":"hi"}`, http.StatusBadRequest, nil},
+		{"upstream fails", user, `{"to":"broken"}`, http.StatusBadRequest, nil},
+		{"role not allowed", service, `{"to":"+15555550100"}`, http.StatusForbidden, nil},
+		{"anonymous", nil, `{"to":"+15555550100"}`, http.StatusUnauthorized, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/handle", nil)
+			if tt.principal != nil {
+				r = r.WithContext(context.WithValue(r.Context(), principalKey, tt.principal))
+			}
+
+			status, response := app.runActionRecorded(r, RequestPayload{Action: "sms", Payload: json.RawMessage(tt.payload)})
+
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", status, tt.wantStatus, response.Message)
+			}
+
+			if tt.wantData != nil && response.Data != tt.wantData {
+				t.Errorf("data = %v, want %v", response.Data, tt.wantData)
+			}
+
+			if tt.wantData != nil && received["body"] != "hi" {
+				t.Errorf("upstream received %v, want the payload passed through", received)
+			}
+		})
+	}
+}
+
+func TestForwardActionPoliciesStayWithTheirConfig(t *testing.T) {
+	public := newForwardTestApp(t, forwardSettings{Name: "ping", URL: "http://upstream/ping", Public: true})
+	other := newForwardTestApp(t)
+
+	if !public.actions.policy("ping").Public {
+		t.Error("the forward action's policy should be registered with it")
+	}
+
+	if other.actions.policy("ping").Public {
+		t.Error("another Config should not see the forward action's policy")
+	}
+
+	if !other.actions.policy("auth").Public {
+		t.Error("every Config should start with the built-in policies")
+	}
+}
+
+func TestMapResponseData(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		field   string
+		want    string
+		wantErr bool
+	}{
+		{"field", `{"id":"1","ok":true}`, "id", `"1"`, false},
+		{"whole body", `{"id":"1"}`, ".", `{"id":"1"}`, false},
+		{"missing field", `{"id":"1"}`, "other", `null`, false},
+		{"not an object", `[1,2]`, "id", ``, true},
+		{"not JSON", `oops`, "id", ``, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := mapResponseData([]byte(tt.body), tt.field)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mapResponseData() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got, _ := json.Marshal(data)
+			if string(got) != tt.want {
+				t.Errorf("data = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -10,17 +10,51 @@ import (
 	"log"
 	"net/http"
 	"net/rpc"
+	"os"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+// RequestPayload is the /handle envelope. The action's own payload sits in the field
+// named after it and is kept raw until the action registry decodes it.
 type RequestPayload struct {
-	Action string      `json:"action"`
-	Auth   AuthPayload `json:"auth,omitempty"`
-	Log    LogPayload  `json:"log,omitempty"`
-	Mail   MailPayload `json:"mail,omitempty"`
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"-"`
+}
+
+func (p *RequestPayload) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	if raw, ok := fields["action"]; ok {
+		err = json.Unmarshal(raw, &p.Action)
+		if err != nil {
+			return errors.New("action must be a string")
+		}
+	}
+
+	p.Payload = fields[p.Action]
+
+	return nil
+}
+
+func (p RequestPayload) MarshalJSON() ([]byte, error) {
+	fields := map[string]any{
+		"action": p.Action,
+	}
+
+	if len(p.Payload) > 0 {
+		fields[p.Action] = p.Payload
+	}
+
+	return json.Marshal(fields)
 }
 
 type AuthPayload struct {
@@ -31,6 +65,9 @@ type AuthPayload struct {
 type LogPayload struct {
 	Name string `json:"name"`
 	Data string `json:"data"`
+	// Severity and Category make up the routing key when logging through the queue, log.<SEVERITY>.<category>
+	Severity string `json:"severity,omitempty"`
+	Category string `json:"category,omitempty"`
 }
 
 type MailPayload struct {
@@ -38,6 +75,17 @@ type MailPayload struct {
 	To      string `json:"to"`
 	Subject string `json:"subject"`
 	Message string `json:"message"`
+	// Mode is "sync" or "queued", defaulting to the mail settings
+	Mode string `json:"mode,omitempty"`
+	// SendAt or Delay hold the mail back, see schedule.go
+	SendAt *time.Time `json:"send_at,omitempty"`
+	Delay  string     `json:"delay,omitempty"`
+}
+
+// sessionResponse is returned by a successful "auth" action
+type sessionResponse struct {
+	User any `json:"user"`
+	tokenPair
 }
 
 func (app *Config) Broker(w http.ResponseWriter, r *http.Request) {
@@ -58,18 +106,70 @@ func (app *Config) HandleSubmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch requestPayload.Action {
-	case "auth":
-		app.authenticate(w, requestPayload.Auth)
-	case "log":
-		// app.logItem(w, requestPayload.Log)
-		// app.logItemViaQueue(w, requestPayload.Log)
-		app.logItemViaRpc(w, requestPayload.Log)
-	case "mail":
-		app.sendMail(w, requestPayload.Mail)
-	default:
-		app.errorJson(w, errors.New("unknown action"), http.StatusBadRequest)
+	if !app.admitAction(w, r, requestPayload.Action) {
+		return
+	}
+
+	action, payload, err := app.prepareAction(requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if wantsAsync(r) {
+		app.submitJob(w, r, requestPayload)
+		return
 	}
+
+	app.handleAction(w, action, payload)
+}
+
+// admitAction authorizes and rate limits an action, writing the error response if it may not run.
+// Unknown actions are turned away first, so they get a 400 whoever is calling.
+func (app *Config) admitAction(w http.ResponseWriter, r *http.Request, action string) bool {
+	if _, ok := app.actions.lookup(action); !ok {
+		app.errorJson(w, errors.New("unknown action"))
+		return false
+	}
+
+	status, err := app.authorizeAction(r, action)
+	if err != nil {
+		app.errorJson(w, err, status)
+		return false
+	}
+
+	return app.allowAction(w, r, action)
+}
+
+// runAction performs an already admitted action
+func (app *Config) runAction(w http.ResponseWriter, requestPayload RequestPayload) {
+	action, payload, err := app.prepareAction(requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	app.handleAction(w, action, payload)
+}
+
+// runActionRecorded runs an action for callers that report the outcome somewhere other than the HTTP response,
+// returning the status and jsonResponse it wrote. It is admitted for r first, unless r is nil because the
+// action was admitted when it was queued.
+func (app *Config) runActionRecorded(r *http.Request, requestPayload RequestPayload) (int, jsonResponse) {
+	rec := newResponseRecorder()
+
+	if r == nil || app.admitAction(rec, r, requestPayload.Action) {
+		app.runAction(rec, requestPayload)
+	}
+
+	var response jsonResponse
+	err := json.Unmarshal(rec.body.Bytes(), &response)
+	if err != nil {
+		log.Printf("::runActionRecorded - %s gave an unreadable response: %s", requestPayload.Action, err)
+		response = jsonResponse{Error: true, Message: "unreadable response from action"}
+	}
+
+	return rec.status, response
 }
 
 func (app *Config) authenticate(w http.ResponseWriter, a AuthPayload) {
@@ -114,14 +214,37 @@ func (app *Config) authenticate(w http.ResponseWriter, a AuthPayload) {
 		return
 	}
 
+	tokens, err := app.tokens.issuePair(a.Email, rolesFor(a.Email), nil)
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
 	var payloadResponse jsonResponse
 	payloadResponse.Error = false
 	payloadResponse.Message = "Authenticated!"
-	payloadResponse.Data = jsonFromService.Data
+	payloadResponse.Data = sessionResponse{
+		User:      jsonFromService.Data,
+		tokenPair: tokens,
+	}
 
 	app.writeJson(w, http.StatusOK, payloadResponse)
 }
 
+// rolesFor gives every user the "user" role, plus "admin" for addresses listed in ADMIN_EMAILS
+func rolesFor(email string) []string {
+	roles := []string{"user"}
+
+	for _, admin := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && strings.EqualFold(admin, email) {
+			roles = append(roles, "admin")
+			break
+		}
+	}
+
+	return roles
+}
+
 func (app *Config) logItem(w http.ResponseWriter, entry LogPayload) {
 	log.Printf("::logItem - called with N:'%s' D:'%s'", entry.Name, entry.Data)
 
@@ -161,13 +284,33 @@ func (app *Config) logItem(w http.ResponseWriter, entry LogPayload) {
 }
 
 func (app *Config) sendMail(w http.ResponseWriter, msg MailPayload) {
+	app.sendMailContext(context.Background(), w, msg)
+}
+
+// sendMailContext is sendMail for callers that need to bound how long it takes, such as the mail scheduler
+func (app *Config) sendMailContext(ctx context.Context, w http.ResponseWriter, msg MailPayload) {
+	if sendAt, ok := msg.sendAt(); ok {
+		app.scheduleMail(w, msg, sendAt)
+		return
+	}
+
+	if msg.Mode == "" {
+		msg.Mode = app.settings.Mail.Mode
+	}
+
+	if msg.Mode == "queued" {
+		app.queueMail(ctx, w, msg)
+		return
+	}
+	msg.Mode = ""
+
 	log.Printf("::sendMail - called with F:'%s' T:'%s' S:'%s' M:'%s'", msg.From, msg.To, msg.Subject, msg.Message)
 
 	jsonData, _ := json.MarshalIndent(msg, "", "\t")
 
 	mailServiceUrl := "http://mail-service/send"
 
-	request, err := http.NewRequest("POST", mailServiceUrl, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", mailServiceUrl, bytes.NewBuffer(jsonData))
 	if err != nil {
 		app.errorJson(w, err)
 		return
@@ -201,7 +344,11 @@ func (app *Config) sendMail(w http.ResponseWriter, msg MailPayload) {
 func (app *Config) logItemViaQueue(w http.ResponseWriter, entry LogPayload) {
 	log.Printf("::logItemViaQueue - called with N:'%s' D:'%s'", entry.Name, entry.Data)
 
-	err := app.pushToQueue(entry.Name, entry.Data)
+	err := app.pushToQueue(entry)
+	if errors.Is(err, errRabbitUnavailable) {
+		app.errorJson(w, err, http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		app.errorJson(w, err)
 		return
@@ -214,20 +361,20 @@ func (app *Config) logItemViaQueue(w http.ResponseWriter, entry LogPayload) {
 	app.writeJson(w, http.StatusAccepted, payloadResponse)
 }
 
-func (app *Config) pushToQueue(name, message string) error {
-	emmitter, err := event.NewEmitter(app.Rabbit)
+func (app *Config) pushToQueue(entry LogPayload) error {
+	emmitter, err := app.newEmitter()
 	if err != nil {
 		return err
 	}
 
-	payload := LogPayload{
-		Name: name,
-		Data: message,
+	payload := event.Payload{
+		Name:     entry.Name,
+		Data:     entry.Data,
+		Severity: entry.Severity,
+		Category: entry.Category,
 	}
 
-	j, _ := json.MarshalIndent(&payload, "", "\t")
-
-	err = emmitter.Push(string(j), "log.INFO")
+	err = emmitter.Publish(context.Background(), payload.Event())
 	if err != nil {
 		return err
 	}
@@ -235,6 +382,56 @@ func (app *Config) pushToQueue(name, message string) error {
 	return nil
 }
 
+// newEmitter returns an Emmitter publishing in the configured event format. With an outbox
+// it doesn't need RabbitMQ, the relay publishes once it is reachable.
+func (app *Config) newEmitter() (event.Emmitter, error) {
+	if app.outbox != nil {
+		return event.Emmitter{Format: app.eventFormat, Outbox: app.outbox}, nil
+	}
+
+	conn := app.rabbit.Current()
+	if conn == nil {
+		return event.Emmitter{}, errRabbitUnavailable
+	}
+
+	emmitter, err := event.NewEmitter(conn)
+	if err != nil {
+		return emmitter, err
+	}
+
+	emmitter.Format = app.eventFormat
+	emmitter.Outbox = app.outbox
+
+	return emmitter, nil
+}
+
+// logRequestPayload accepts the /handle envelope as well as the older {"log": {...}} body and a bare log entry,
+// which is what /log-grpc took before it went through the action registry
+func logRequestPayload(body json.RawMessage) (RequestPayload, error) {
+	var requestPayload RequestPayload
+
+	err := json.Unmarshal(body, &requestPayload)
+	if err != nil {
+		return requestPayload, err
+	}
+
+	if requestPayload.Action != "" {
+		return requestPayload, nil
+	}
+
+	requestPayload.Action = "log"
+
+	var fields map[string]json.RawMessage
+	_ = json.Unmarshal(body, &fields)
+
+	requestPayload.Payload = fields["log"]
+	if len(requestPayload.Payload) == 0 {
+		requestPayload.Payload = body
+	}
+
+	return requestPayload, nil
+}
+
 type RpcPayload struct {
 	Name string
 	Data string
@@ -269,15 +466,32 @@ func (app *Config) logItemViaRpc(w http.ResponseWriter, entry LogPayload) {
 
 func (app *Config) logItemViaGrpc(w http.ResponseWriter, r *http.Request) {
 	log.Printf("::logItemViaGrpc")
-	var requestPayload RequestPayload
+	var body json.RawMessage
 
-	err := app.readJson(w, r, &requestPayload)
+	err := app.readJson(w, r, &body)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	requestPayload, err := logRequestPayload(body)
 	if err != nil {
 		app.errorJson(w, err)
 		return
 	}
 
-	log.Printf("::logItemViaGrpc - called with N:'%s' D:'%s'", requestPayload.Log.Name, requestPayload.Log.Data)
+	if !app.admitAction(w, r, "log") {
+		return
+	}
+
+	action, payload, err := app.prepareAction(requestPayload)
+	if err != nil || action.Name() != "log" {
+		app.errorJson(w, errors.New("a valid log payload is required"))
+		return
+	}
+	entry := payload.(LogPayload)
+
+	log.Printf("::logItemViaGrpc - called with N:'%s' D:'%s'", entry.Name, entry.Data)
 
 	conn, err := grpc.Dial("logger-service:50001", grpc.WithTransportCredentials(insecure.NewCredentials().Clone()), grpc.WithBlock())
 	if err != nil {
@@ -293,8 +507,8 @@ func (app *Config) logItemViaGrpc(w http.ResponseWriter, r *http.Request) {
 
 	_, err = client.WriteLog(ctx, &logs.LogRequest{
 		LogEntry: &logs.Log{
-			Name: requestPayload.Log.Name,
-			Data: requestPayload.Log.Data,
+			Name: entry.Name,
+			Data: entry.Data,
 		},
 	})
 	if err != nil {
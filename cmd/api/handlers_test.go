@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogRequestPayload(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantAction string
+		wantName   string
+	}{
+		{"envelope", `{"action":"log","log":{"name":"event","data":"d"}}`, "log", "event"},
+		{"log field only", `{"log":{"name":"event","data":"d"}}`, "log", "event"},
+		{"bare entry", `{"name":"event","data":"d"}`, "log", "event"},
+		{"other action", `{"action":"mail","mail":{}}`, "mail", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestPayload, err := logRequestPayload(json.RawMessage(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if requestPayload.Action != tt.wantAction {
+				t.Errorf("action = %q, want %q", requestPayload.Action, tt.wantAction)
+			}
+
+			if tt.wantName == "" {
+				return
+			}
+
+			var entry LogPayload
+			if err := json.Unmarshal(requestPayload.Payload, &entry); err != nil || entry.Name != tt.wantName {
+				t.Errorf("payload = %s, want a log entry named %q", requestPayload.Payload, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestAdmitActionRejectsUnknownActionsFirst(t *testing.T) {
+	limiter, err := newRateLimiter(rateLimitSettings{Client: rateLimitRule{Requests: 1, Per: "1s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Config{actions: newActionRegistry(), limiter: limiter}
+	if err := app.registerDefaultActions(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		action     string
+		wantStatus int
+	}{
+		{"nope", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+		{"log", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		if app.admitAction(rr, httptest.NewRequest("POST", "/handle", nil), tt.action) {
+			t.Errorf("%q was admitted for an anonymous caller", tt.action)
+		}
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%q: status %d, want %d", tt.action, rr.Code, tt.wantStatus)
+		}
+	}
+}
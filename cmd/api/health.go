@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheck is a single probe run by the readiness endpoint.
+// Critical checks decide readiness, non-critical ones are only reported.
+type healthCheck struct {
+	Name     string
+	Critical bool
+	Check    func(ctx context.Context) error
+}
+
+type healthResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status      string         `json:"status"`
+	Critical    []healthResult `json:"critical"`
+	NonCritical []healthResult `json:"non_critical"`
+}
+
+func (app *Config) addHealthCheck(check healthCheck) {
+	app.healthChecks = append(app.healthChecks, check)
+}
+
+func (app *Config) registerDefaultHealthChecks() {
+	// With an outbox, events wait for RabbitMQ to come back, so a short outage needn't take the broker
+	// out of rotation. The outbox check does once the relay has been cut off for longer than its grace.
+	rabbitCritical := app.outbox == nil
+
+	app.addHealthCheck(healthCheck{
+		Name:     "rabbitmq",
+		Critical: rabbitCritical,
+		Check:    app.checkRabbit,
+	})
+
+	app.addHealthCheck(healthCheck{
+		Name:  "logger-grpc",
+		Check: checkGrpcService("logger-service:50001", "logs.LogService"),
+	})
+
+	// Upstreams only affect the actions that use them, so none of them take the broker out of rotation
+	app.addHealthCheck(healthCheck{
+		Name:  "authentication-service",
+		Check: checkHttpService("http://authentication-service/ping"),
+	})
+
+	app.addHealthCheck(healthCheck{
+		Name:  "logger-service",
+		Check: checkHttpService("http://logger-service/ping"),
+	})
+
+	app.addHealthCheck(healthCheck{
+		Name:  "mail-service",
+		Check: checkHttpService("http://mail-service/ping"),
+	})
+
+	app.addHealthCheck(healthCheck{
+		Name:     "consumers",
+		Critical: rabbitCritical,
+		Check:    app.checkConsumers,
+	})
+
+	if app.outbox != nil {
+		app.addHealthCheck(healthCheck{
+			Name:     "outbox",
+			Critical: true,
+			Check:    app.checkOutbox,
+		})
+	}
+}
+
+// Liveness only covers the broker process itself, so it runs no checks and answers as long as the
+// process can serve requests. RabbitMQ and the consumers count towards readiness, restarting the pod
+// over an AMQP blip would only add a restart loop on top.
+func (app *Config) HealthLive(w http.ResponseWriter, r *http.Request) {
+	app.writeHealthReport(w, r, nil)
+}
+
+func (app *Config) HealthReady(w http.ResponseWriter, r *http.Request) {
+	app.writeHealthReport(w, r, app.healthChecks)
+}
+
+func (app *Config) writeHealthReport(w http.ResponseWriter, r *http.Request, checks []healthCheck) {
+	report := runHealthChecks(r.Context(), checks)
+
+	// A degraded broker still serves the actions whose upstreams are up, so only unavailable fails the probe
+	payload := jsonResponse{
+		Error:   report.Status == "unavailable",
+		Message: report.Status,
+		Data:    report,
+	}
+
+	status := http.StatusOK
+	if payload.Error {
+		status = http.StatusServiceUnavailable
+	}
+
+	_ = app.writeJson(w, status, payload)
+}
+
+// runHealthChecks runs every check concurrently, each with its own timeout
+func runHealthChecks(ctx context.Context, checks []healthCheck) healthReport {
+	results := make([]healthResult, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Check(checkCtx)
+
+			results[i] = healthResult{
+				Name:      check.Name,
+				Status:    "ok",
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				results[i].Status = "failing"
+				results[i].Error = err.Error()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := healthReport{
+		Status:      "ok",
+		Critical:    []healthResult{},
+		NonCritical: []healthResult{},
+	}
+
+	for i, result := range results {
+		if checks[i].Critical {
+			report.Critical = append(report.Critical, result)
+			if result.Status != "ok" {
+				report.Status = "unavailable"
+			}
+		} else {
+			report.NonCritical = append(report.NonCritical, result)
+		}
+	}
+
+	if report.Status == "ok" {
+		for _, result := range report.NonCritical {
+			if result.Status != "ok" {
+				report.Status = "degraded"
+				break
+			}
+		}
+	}
+
+	return report
+}
+
+func (app *Config) checkRabbit(ctx context.Context) error {
+	if app.rabbit == nil || app.rabbit.Current() == nil {
+		return errors.New("connection to RabbitMQ is closed")
+	}
+
+	return nil
+}
+
+func (app *Config) checkConsumers(ctx context.Context) error {
+	for _, consumer := range app.consumers {
+		if !consumer.Alive() {
+			return fmt.Errorf("%s consumer is not listening", consumer.Name)
+		}
+	}
+
+	return nil
+}
+
+func (app *Config) checkOutbox(ctx context.Context) error {
+	stalled := app.outbox.Stalled()
+	if stalled > app.outboxGrace {
+		return fmt.Errorf("the outbox relay has not reached RabbitMQ for %s, %d events waiting", stalled.Round(time.Second), app.outbox.Depth())
+	}
+
+	return nil
+}
+
+func checkHttpService(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status code %d", response.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+func checkGrpcService(address, service string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		response, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{
+			Service: service,
+		})
+		if err != nil {
+			return err
+		}
+
+		if response.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("service status is %s", response.Status)
+		}
+
+		return nil
+	}
+}
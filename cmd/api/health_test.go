@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	failing := func(ctx context.Context) error { return errors.New("down") }
+	passing := func(ctx context.Context) error { return nil }
+
+	tests := []struct {
+		name       string
+		checks     []healthCheck
+		handler    func(app *Config) http.HandlerFunc
+		wantStatus int
+	}{
+		{"ready", []healthCheck{{Name: "a", Critical: true, Check: passing}}, func(app *Config) http.HandlerFunc { return app.HealthReady }, http.StatusOK},
+		{"ready with a failing upstream", []healthCheck{{Name: "a", Check: failing}}, func(app *Config) http.HandlerFunc { return app.HealthReady }, http.StatusOK},
+		{"not ready", []healthCheck{{Name: "a", Critical: true, Check: failing}}, func(app *Config) http.HandlerFunc { return app.HealthReady }, http.StatusServiceUnavailable},
+		{"live regardless of dependencies", []healthCheck{{Name: "a", Critical: true, Check: failing}}, func(app *Config) http.HandlerFunc { return app.HealthLive }, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Config{healthChecks: tt.checks}
+
+			w := httptest.NewRecorder()
+			tt.handler(app)(w, httptest.NewRequest("GET", "/healthz", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
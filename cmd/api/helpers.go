@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 )
 
 type jsonResponse struct {
@@ -16,7 +19,11 @@ type jsonResponse struct {
 func (app *Config) readJson(w http.ResponseWriter, r *http.Request, data any) error {
 	maxBytes := 1048576// 1Mb
 
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	return app.readJsonWithLimit(w, r, data, int64(maxBytes))
+}
+
+func (app *Config) readJsonWithLimit(w http.ResponseWriter, r *http.Request, data any, maxBytes int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
 	dec := json.NewDecoder(r.Body)
 	err := dec.Decode(data)
@@ -68,4 +75,61 @@ func (app *Config) errorJson(w http.ResponseWriter, err error, status ...int) er
 	payload.Message = err.Error()
 
 	return app.writeJson(w, statusCode, payload)
-}
\ No newline at end of file
+}
+
+func envOrDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// writeFileAtomic writes data to a temporary file next to path, named from prefix, then renames it over path
+// so a crash never leaves a half written file
+func writeFileAtomic(path, prefix string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), prefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// responseRecorder captures a handler's response so it can be stored or replayed later
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		header: http.Header{},
+		status: http.StatusOK,
+	}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type idempotencySettings struct {
+	TTL string `json:"ttl"`
+}
+
+type idempotentResponse struct {
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+type idempotencyRecord struct {
+	bodyHash  string
+	inFlight  bool
+	response  idempotentResponse
+	expiresAt time.Time
+}
+
+// idempotencyStore remembers the first response for each client and Idempotency-Key
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[string]*idempotencyRecord
+}
+
+func newIdempotencyStore(s idempotencySettings) (*idempotencyStore, error) {
+	ttl, err := time.ParseDuration(s.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid idempotency ttl: %w", err)
+	}
+
+	store := &idempotencyStore{
+		ttl:     ttl,
+		records: map[string]*idempotencyRecord{},
+	}
+
+	go store.expire()
+
+	return store, nil
+}
+
+var (
+	errIdempotencyInFlight = errors.New("a request with this Idempotency-Key is still in progress")
+	errIdempotencyMismatch = errors.New("Idempotency-Key was already used with a different request body")
+)
+
+// begin claims key for a new request, or returns the stored response to replay
+func (s *idempotencyStore) begin(key, bodyHash string) (*idempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[key]
+	if ok && time.Now().After(record.expiresAt) {
+		ok = false
+	}
+
+	if !ok {
+		s.records[key] = &idempotencyRecord{
+			bodyHash:  bodyHash,
+			inFlight:  true,
+			expiresAt: time.Now().Add(s.ttl),
+		}
+		return nil, nil
+	}
+
+	if record.bodyHash != bodyHash {
+		return nil, errIdempotencyMismatch
+	}
+
+	if record.inFlight {
+		return nil, errIdempotencyInFlight
+	}
+
+	response := record.response
+	return &response, nil
+}
+
+func (s *idempotencyStore) complete(key string, response idempotentResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[key]
+	if !ok {
+		return
+	}
+
+	record.inFlight = false
+	record.response = response
+	record.expiresAt = time.Now().Add(s.ttl)
+}
+
+// release forgets key so the client can retry, used when the response is not worth keeping
+func (s *idempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+}
+
+func (s *idempotencyStore) expire() {
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		for key, record := range s.records {
+			if !record.inFlight && time.Now().After(record.expiresAt) {
+				delete(s.records, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// idempotent honours the Idempotency-Key header. Rate limited and 5xx responses aren't stored so they can be retried.
+func (app *Config) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			app.errorJson(w, errors.New("Idempotency-Key is too long"))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			app.errorJson(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		scopedKey := app.clientKey(r) + ":" + r.URL.Path + ":" + key
+
+		replay, err := app.idempotency.begin(scopedKey, hex.EncodeToString(sum[:]))
+		if errors.Is(err, errIdempotencyInFlight) {
+			app.errorJson(w, err, http.StatusConflict)
+			return
+		} else if err != nil {
+			app.errorJson(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if replay != nil {
+			for name, values := range replay.headers {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(replay.status)
+			_, _ = w.Write(replay.body)
+			return
+		}
+
+		// Free the key if the handler panics, otherwise it stays in flight until it expires
+		completed := false
+		defer func() {
+			if !completed {
+				app.idempotency.release(scopedKey)
+			}
+		}()
+
+		rec := newResponseRecorder()
+		next.ServeHTTP(rec, r)
+
+		if rec.status != http.StatusTooManyRequests && rec.status < 500 {
+			app.idempotency.complete(scopedKey, idempotentResponse{
+				status:  rec.status,
+				headers: rec.header.Clone(),
+				body:    rec.body.Bytes(),
+			})
+			completed = true
+		}
+
+		for name, values := range rec.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(rec.status)
+		_, _ = w.Write(rec.body.Bytes())
+	})
+}
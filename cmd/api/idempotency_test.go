@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newIdempotentApp(t *testing.T) *Config {
+	t.Helper()
+
+	store, err := newIdempotencyStore(idempotencySettings{TTL: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter, err := newRateLimiter(rateLimitSettings{Client: rateLimitRule{Requests: 1, Per: "1s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Config{idempotency: store, limiter: limiter}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	var calls int32
+	status := http.StatusAccepted
+
+	app := newIdempotentApp(t)
+	handler := app.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-Call", string(rune('0'+n)))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"error":false,"message":"logged"}`))
+	}))
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/handle", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	tests := []struct {
+		name         string
+		key          string
+		body         string
+		wantStatus   int
+		wantReplayed bool
+		wantCalls    int32
+	}{
+		{"first request runs", "k1", `{"action":"log"}`, http.StatusAccepted, false, 1},
+		{"same key and body replays", "k1", `{"action":"log"}`, http.StatusAccepted, true, 1},
+		{"same key, different body", "k1", `{"action":"mail"}`, http.StatusUnprocessableEntity, false, 1},
+		{"new key runs", "k2", `{"action":"log"}`, http.StatusAccepted, false, 2},
+		{"no key always runs", "", `{"action":"log"}`, http.StatusAccepted, false, 3},
+		{"too long key", strings.Repeat("k", 256), `{}`, http.StatusBadRequest, false, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := send(tt.key, tt.body)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+
+	// The replay carries the original headers
+	if rr := send("k1", `{"action":"log"}`); rr.Header().Get("X-Call") != "1" {
+		t.Errorf("replayed X-Call = %q, want the first response's 1", rr.Header().Get("X-Call"))
+	}
+
+	// Server errors aren't kept, so the client can retry
+	status = http.StatusBadGateway
+	send("k3", `{}`)
+	status = http.StatusAccepted
+	if rr := send("k3", `{}`); rr.Code != http.StatusAccepted || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a 502: status %d, replayed %q, want a fresh 202", rr.Code, rr.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotentInFlight(t *testing.T) {
+	store, err := newIdempotencyStore(idempotencySettings{TTL: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.begin("k", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.begin("k", "hash"); err != errIdempotencyInFlight {
+		t.Fatalf("second begin while in flight = %v, want %v", err, errIdempotencyInFlight)
+	}
+
+	store.release("k")
+	if _, err := store.begin("k", "hash"); err != nil {
+		t.Fatalf("begin after release = %v, want the key free again", err)
+	}
+}
+
+func TestIdempotentReleasesOnPanic(t *testing.T) {
+	app := newIdempotentApp(t)
+
+	panics := true
+	handler := app.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if panics {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the handler's panic to propagate")
+			}
+		}()
+		r := httptest.NewRequest("POST", "/handle", strings.NewReader(`{}`))
+		r.Header.Set("Idempotency-Key", "k")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+
+	panics = false
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/handle", strings.NewReader(`{}`))
+	r.Header.Set("Idempotency-Key", "k")
+	handler.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("retry after a panic: status %d, want %d", rr.Code, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+type jobSettings struct {
+	Workers   int    `json:"workers"`
+	QueueSize int    `json:"queue_size"`
+	Retention string `json:"retention"`
+}
+
+// job is an action accepted with "Prefer: respond-async" and run in the background
+type job struct {
+	ID         string        `json:"id"`
+	Action     string        `json:"action"`
+	Status     string        `json:"status"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Result     *jsonResponse `json:"result,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+
+	// owner is the submitter's client key, see clientKey
+	owner   string
+	payload RequestPayload
+}
+
+// jobRunner runs jobs on a fixed pool of workers and keeps their records for the retention period.
+// Records live in this replica's memory, so GET /jobs/{id} has to reach the replica that took the job.
+type jobRunner struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	queue     chan *job
+	retention time.Duration
+}
+
+func newJobRunner(s jobSettings, run func(r *http.Request, requestPayload RequestPayload) (int, jsonResponse)) (*jobRunner, error) {
+	retention, err := time.ParseDuration(s.Retention)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job retention: %w", err)
+	}
+
+	if s.Workers <= 0 || s.QueueSize <= 0 {
+		return nil, errors.New("job workers and queue_size must be positive")
+	}
+
+	runner := &jobRunner{
+		jobs:      map[string]*job{},
+		queue:     make(chan *job, s.QueueSize),
+		retention: retention,
+	}
+
+	for i := 0; i < s.Workers; i++ {
+		go runner.work(run)
+	}
+
+	go runner.expire()
+
+	return runner, nil
+}
+
+func (jr *jobRunner) submit(owner string, requestPayload RequestPayload) (*job, error) {
+	j := &job{
+		ID:        randomId(16),
+		Action:    requestPayload.Action,
+		Status:    jobQueued,
+		CreatedAt: time.Now(),
+		owner:     owner,
+		payload:   requestPayload,
+	}
+
+	jr.mu.Lock()
+	jr.jobs[j.ID] = j
+	jr.mu.Unlock()
+
+	select {
+	case jr.queue <- j:
+		return j, nil
+	default:
+		jr.mu.Lock()
+		delete(jr.jobs, j.ID)
+		jr.mu.Unlock()
+		return nil, errors.New("job queue is full")
+	}
+}
+
+func (jr *jobRunner) work(run func(r *http.Request, requestPayload RequestPayload) (int, jsonResponse)) {
+	for j := range jr.queue {
+		started := time.Now()
+		jr.update(j, func(j *job) {
+			j.Status = jobRunning
+			j.StartedAt = &started
+		})
+
+		// Jobs were admitted when they were submitted
+		status, result := run(nil, j.payload)
+
+		finished := time.Now()
+		jr.update(j, func(j *job) {
+			j.Status = jobSucceeded
+			if status >= 400 || result.Error {
+				j.Status = jobFailed
+			}
+			j.StatusCode = status
+			j.Result = &result
+			j.FinishedAt = &finished
+		})
+	}
+}
+
+func (jr *jobRunner) update(j *job, change func(j *job)) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	change(j)
+}
+
+func (jr *jobRunner) get(id string) (job, bool) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	j, ok := jr.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+
+	return *j, true
+}
+
+// expire forgets finished jobs once they are older than the retention period
+func (jr *jobRunner) expire() {
+	interval := jr.retention / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		jr.mu.Lock()
+		for id, j := range jr.jobs {
+			if j.FinishedAt != nil && time.Since(*j.FinishedAt) > jr.retention {
+				delete(jr.jobs, id)
+			}
+		}
+		jr.mu.Unlock()
+	}
+}
+
+// wantsAsync is true for "Prefer: respond-async" or ?async=true
+func wantsAsync(r *http.Request) bool {
+	if r.URL.Query().Get("async") == "true" {
+		return true
+	}
+
+	for _, prefer := range r.Header.Values("Prefer") {
+		for _, token := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (app *Config) submitJob(w http.ResponseWriter, r *http.Request, requestPayload RequestPayload) {
+	j, err := app.jobs.submit(app.clientKey(r), requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "accepted"
+	payloadResponse.Data = map[string]string{
+		"job_id": j.ID,
+		"status": j.Status,
+	}
+
+	headers := http.Header{}
+	headers.Set("Location", "/jobs/"+j.ID)
+
+	app.writeJson(w, http.StatusAccepted, payloadResponse, headers)
+}
+
+// GetJob returns a job's status and, once it has finished, its result.
+// Jobs are only visible to the client that submitted them, by API key, user or IP, and to admins.
+func (app *Config) GetJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := app.jobs.get(chi.URLParam(r, "id"))
+	if !ok {
+		app.errorJson(w, errors.New("job not found"), http.StatusNotFound)
+		return
+	}
+
+	p := principalFrom(r.Context())
+	admin := p != nil && contains(p.Roles, "admin")
+
+	if j.owner != app.clientKey(r) && !admin {
+		app.errorJson(w, errors.New("job not found"), http.StatusNotFound)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = j.Status
+	payloadResponse.Data = j
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
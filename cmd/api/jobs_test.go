@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestJobRunner(t *testing.T, s jobSettings, run func(r *http.Request, requestPayload RequestPayload) (int, jsonResponse)) *jobRunner {
+	t.Helper()
+
+	runner, err := newJobRunner(s, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return runner
+}
+
+// waitForJob polls until the job has finished
+func waitForJob(t *testing.T, runner *jobRunner, id string) job {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		j, ok := runner.get(id)
+		if ok && j.FinishedAt != nil {
+			return j
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s did not finish", id)
+	return job{}
+}
+
+func TestJobRunnerRecordsResults(t *testing.T) {
+	runner := newTestJobRunner(t, jobSettings{Workers: 2, QueueSize: 10, Retention: "1h"}, func(r *http.Request, requestPayload RequestPayload) (int, jsonResponse) {
+		if r != nil {
+			t.Error("jobs are admitted when they are submitted, not when they run")
+		}
+		if requestPayload.Action == "fail" {
+			return http.StatusBadGateway, jsonResponse{Error: true, Message: "upstream failed"}
+		}
+		return http.StatusAccepted, jsonResponse{Message: "done"}
+	})
+
+	tests := []struct {
+		action     string
+		wantStatus string
+		wantCode   int
+	}{
+		{"log", jobSucceeded, http.StatusAccepted},
+		{"fail", jobFailed, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			submitted, err := runner.submit("ip:192.0.2.1", RequestPayload{Action: tt.action})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			j := waitForJob(t, runner, submitted.ID)
+			if j.Status != tt.wantStatus || j.StatusCode != tt.wantCode || j.Result == nil {
+				t.Errorf("job = %s %d %v, want %s %d with a result", j.Status, j.StatusCode, j.Result, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestJobRunnerRejectsWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	runner := newTestJobRunner(t, jobSettings{Workers: 1, QueueSize: 1, Retention: "1h"}, func(r *http.Request, requestPayload RequestPayload) (int, jsonResponse) {
+		<-block
+		return http.StatusOK, jsonResponse{}
+	})
+
+	// One job running, one queued, then the queue is full
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		_, err = runner.submit("", RequestPayload{Action: "log"})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err == nil {
+		t.Fatal("submit() should fail once the queue is full")
+	}
+}
+
+func TestGetJobIsBoundToTheSubmitter(t *testing.T) {
+	limiter, err := newRateLimiter(rateLimitSettings{Client: rateLimitRule{Requests: 100, Per: "1s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Config{limiter: limiter}
+	app.jobs = newTestJobRunner(t, jobSettings{Workers: 1, QueueSize: 10, Retention: "1h"}, func(r *http.Request, requestPayload RequestPayload) (int, jsonResponse) {
+		return http.StatusOK, jsonResponse{Message: "done"}
+	})
+
+	mux := chi.NewRouter()
+	mux.Get("/jobs/{id}", app.GetJob)
+
+	submit := func(r *http.Request) string {
+		w := httptest.NewRecorder()
+		app.submitJob(w, r, RequestPayload{Action: "log"})
+
+		var response struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusAccepted {
+			t.Fatalf("submitJob = %d %s", w.Code, w.Body.String())
+		}
+		return response.Data["job_id"]
+	}
+
+	as := func(r *http.Request, p *principal) *http.Request {
+		if p == nil {
+			return r
+		}
+		return r.WithContext(context.WithValue(r.Context(), principalKey, p))
+	}
+
+	request := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest("POST", "/handle", nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	alice := &principal{Subject: "alice", Kind: "user", Roles: []string{"user"}}
+	bob := &principal{Subject: "bob", Kind: "user", Roles: []string{"user"}}
+	admin := &principal{Subject: "root", Kind: "user", Roles: []string{"admin"}}
+
+	anonymousJob := submit(request("192.0.2.1:1234"))
+	aliceJob := submit(as(request("192.0.2.1:1234"), alice))
+
+	tests := []struct {
+		name       string
+		id         string
+		remoteAddr string
+		principal  *principal
+		wantStatus int
+	}{
+		{"anonymous submitter", anonymousJob, "192.0.2.1:5678", nil, http.StatusOK},
+		{"anonymous from another address", anonymousJob, "198.51.100.7:1234", nil, http.StatusNotFound},
+		{"anonymous job read by a user", anonymousJob, "198.51.100.7:1234", bob, http.StatusNotFound},
+		{"user submitter", aliceJob, "198.51.100.7:1234", alice, http.StatusOK},
+		{"another user", aliceJob, "192.0.2.1:1234", bob, http.StatusNotFound},
+		{"same address without the token", aliceJob, "192.0.2.1:1234", nil, http.StatusNotFound},
+		{"admin", aliceJob, "203.0.113.9:1234", admin, http.StatusOK},
+		{"unknown job", "missing", "192.0.2.1:1234", nil, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/jobs/"+tt.id, nil)
+			r.RemoteAddr = tt.remoteAddr
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, as(r, tt.principal))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWantsAsync(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		prefer []string
+		want   bool
+	}{
+		{"plain", "/handle", nil, false},
+		{"query", "/handle?async=true", nil, true},
+		{"prefer", "/handle", []string{"respond-async"}, true},
+		{"prefer among others", "/handle", []string{"return=minimal, Respond-Async"}, true},
+		{"other preference", "/handle", []string{"return=minimal"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.url, nil)
+			for _, prefer := range tt.prefer {
+				r.Header.Add("Prefer", prefer)
+			}
+
+			if got := wantsAsync(r); got != tt.want {
+				t.Errorf("wantsAsync() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"broker/event"
+	"context"
+	"errors"
+	"fmt"
+)
+
+type logSettings struct {
+	// Consumers each deliver the log events on their topics to logger-service from their own queue,
+	// so e.g. errors can have more workers than info logs
+	Consumers []logConsumerSettings `json:"consumers"`
+}
+
+type logConsumerSettings struct {
+	Queue       string   `json:"queue"`
+	Topics      []string `json:"topics"`
+	Concurrency int      `json:"concurrency"`
+}
+
+func (s logSettings) validate() error {
+	queues := map[string]bool{}
+
+	for _, c := range s.Consumers {
+		if c.Queue == "" || len(c.Topics) == 0 || c.Concurrency <= 0 {
+			return errors.New("log consumers need a queue, topics and a positive concurrency")
+		}
+
+		if queues[c.Queue] {
+			return fmt.Errorf("log consumer queue %q is used twice", c.Queue)
+		}
+		queues[c.Queue] = true
+
+		for _, topic := range c.Topics {
+			if !validTopicPattern(topic) {
+				return fmt.Errorf("log consumer %q: invalid topic pattern %q", c.Queue, topic)
+			}
+		}
+	}
+
+	return nil
+}
+
+// startLogConsumers runs a consumer for each configured log queue
+func (app *Config) startLogConsumers() {
+	for _, s := range app.settings.Logs.Consumers {
+		s := s
+		app.startConsumer(s.Queue, func(consumer *event.Consumer) error {
+			return consumer.ConsumeDurable(context.Background(), s.Queue, s.Topics, s.Concurrency, event.HandleLog)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"broker/event"
+	"testing"
+)
+
+func TestDefaultLogConsumersTakeEveryLogEvent(t *testing.T) {
+	s := defaultSettings().Logs
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, severity := range event.Severities {
+		for _, category := range []string{"", "billing"} {
+			key := event.LogRoutingKey(severity, category)
+
+			matched := false
+			for _, c := range s.Consumers {
+				for _, topic := range c.Topics {
+					matched = matched || event.MatchTopic(topic, key)
+				}
+			}
+
+			if !matched {
+				t.Errorf("no default log consumer takes %s", key)
+			}
+		}
+	}
+}
+
+func TestLogSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       logSettings
+		wantErr bool
+	}{
+		{"none", logSettings{}, false},
+		{"split by severity", logSettings{Consumers: []logConsumerSettings{
+			{Queue: "logs_errors", Topics: []string{"log.ERROR.#", "log.FATAL.#"}, Concurrency: 8},
+			{Queue: "logs_rest", Topics: []string{"log.INFO.#", "log.WARN.#"}, Concurrency: 2},
+		}}, false},
+		{"no queue", logSettings{Consumers: []logConsumerSettings{{Topics: []string{"log.#"}, Concurrency: 1}}}, true},
+		{"no topics", logSettings{Consumers: []logConsumerSettings{{Queue: "logs", Concurrency: 1}}}, true},
+		{"no concurrency", logSettings{Consumers: []logConsumerSettings{{Queue: "logs", Topics: []string{"log.#"}}}}, true},
+		{"queue used twice", logSettings{Consumers: []logConsumerSettings{
+			{Queue: "logs", Topics: []string{"log.INFO"}, Concurrency: 1},
+			{Queue: "logs", Topics: []string{"log.WARN"}, Concurrency: 1},
+		}}, true},
+		{"bad topic", logSettings{Consumers: []logConsumerSettings{{Queue: "logs", Topics: []string{"log..x"}, Concurrency: 1}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.s.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
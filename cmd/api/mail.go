@@ -0,0 +1,94 @@
+package main
+
+import (
+	"broker/event"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+type mailSettings struct {
+	// Mode is used when a mail payload doesn't ask for one, "sync" or "queued"
+	Mode string `json:"mode"`
+	// Consumer runs the mail.send consumer in this process, turn it off when a separate worker delivers mail
+	Consumer    bool   `json:"consumer"`
+	Queue       string `json:"queue"`
+	Concurrency int    `json:"concurrency"`
+	// ScheduleStore persists mail sent with send_at or delay. Left empty, scheduled mail is only kept in
+	// memory and is lost when the broker restarts, and each replica only sends what it was given.
+	ScheduleStore       string `json:"schedule_store"`
+	ScheduleRetry       string `json:"schedule_retry"`
+	ScheduleMaxAttempts int    `json:"schedule_max_attempts"`
+	// ScheduleTimeout bounds each scheduled delivery, so one stuck send can't hold up the rest
+	ScheduleTimeout string `json:"schedule_timeout"`
+}
+
+func (s mailSettings) validate() error {
+	if s.Mode != "sync" && s.Mode != "queued" {
+		return errors.New(`mail mode must be "sync" or "queued"`)
+	}
+
+	if s.Consumer && (s.Queue == "" || s.Concurrency <= 0) {
+		return errors.New("mail consumer needs a queue and a positive concurrency")
+	}
+
+	return nil
+}
+
+// queueMail publishes a mail.send event for the mail consumer and answers straight away
+func (app *Config) queueMail(ctx context.Context, w http.ResponseWriter, msg MailPayload) {
+	log.Printf("::queueMail - called with F:'%s' T:'%s' S:'%s'", msg.From, msg.To, msg.Subject)
+
+	emmitter, err := app.newEmitter()
+	if errors.Is(err, errRabbitUnavailable) {
+		app.errorJson(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	mail := event.MailMessage{
+		Version:   event.MailMessageVersion,
+		MessageID: randomId(16),
+		From:      msg.From,
+		To:        msg.To,
+		Subject:   msg.Subject,
+		Message:   msg.Message,
+	}
+
+	j, _ := json.Marshal(&mail)
+
+	err = emmitter.Publish(ctx, event.Event{
+		ID:         mail.MessageID,
+		RoutingKey: event.MailSendTopic,
+		Type:       event.MailSendTopic,
+		Body:       j,
+	})
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "mail queued"
+	payloadResponse.Data = map[string]string{"message_id": mail.MessageID}
+
+	app.writeJson(w, http.StatusAccepted, payloadResponse)
+}
+
+// startMailConsumer delivers queued mail from the durable mail queue
+func (app *Config) startMailConsumer() {
+	s := app.settings.Mail
+	if !s.Consumer {
+		return
+	}
+
+	app.startConsumer("mail", func(consumer *event.Consumer) error {
+		return consumer.ConsumeDurable(context.Background(), s.Queue, []string{event.MailSendTopic}, s.Concurrency, event.HandleMail)
+	})
+}
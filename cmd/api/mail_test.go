@@ -0,0 +1,75 @@
+package main
+
+import (
+	"broker/event"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueuedMailGoesThroughTheOutbox(t *testing.T) {
+	dir := t.TempDir()
+
+	outbox, err := event.OpenOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Config{rabbit: downRabbit(t), outbox: outbox, eventFormat: event.FormatPlain}
+	app.settings.Mail.Mode = "queued"
+
+	w := httptest.NewRecorder()
+	app.sendMail(w, MailPayload{From: "me@example.com", To: "you@example.com", Subject: "hi", Message: "hello"})
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body.String())
+	}
+
+	var response struct {
+		Data map[string]string `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &response)
+	messageID := response.Data["message_id"]
+	if messageID == "" {
+		t.Fatalf("response %s has no message_id", w.Body.String())
+	}
+
+	// The relay hasn't run, so the event is still waiting in the outbox
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 || outbox.Depth() != 1 {
+		t.Fatalf("outbox has %d files and depth %d, want the one mail", len(files), outbox.Depth())
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e event.Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	var mail event.MailMessage
+	if err := json.Unmarshal(e.Body, &mail); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.RoutingKey != event.MailSendTopic || e.ID != messageID || mail.MessageID != messageID || mail.To != "you@example.com" {
+		t.Errorf("queued %s %s with %+v, want mail.send for %s", e.RoutingKey, e.ID, mail, messageID)
+	}
+}
+
+func TestQueuedMailWithoutRabbitOrOutbox(t *testing.T) {
+	app := &Config{rabbit: downRabbit(t), eventFormat: event.FormatPlain}
+
+	w := httptest.NewRecorder()
+	app.sendMail(w, MailPayload{To: "you@example.com", Subject: "hi", Mode: "queued"})
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"broker/event"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// actionMetrics holds per action counters, published with the rest of expvar at /admin/metrics
+var actionMetrics = expvar.NewMap("actions")
+
+// publishOutboxMetrics reports how many events are waiting in the outbox
+func publishOutboxMetrics(outbox *event.Outbox) {
+	expvar.Publish("outbox_depth", expvar.Func(func() any {
+		return outbox.Depth()
+	}))
+}
+
+// handleAction runs an action and records its outcome and latency
+func (app *Config) handleAction(w http.ResponseWriter, action Action, payload any) {
+	ww := middleware.NewWrapResponseWriter(w, 1)
+	start := time.Now()
+
+	action.Handle(ww, payload)
+
+	name := action.Name()
+	actionMetrics.Add(name+".requests", 1)
+	if ww.Status() >= 400 {
+		actionMetrics.Add(name+".errors", 1)
+	}
+	actionMetrics.Add(name+".latency_ms_total", time.Since(start).Milliseconds())
+}
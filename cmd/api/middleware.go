@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type contextKey string
+
+const (
+	principalKey contextKey = "principal"
+	authErrorKey contextKey = "auth-error"
+)
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errForbidden       = errors.New("not allowed to perform this action")
+)
+
+// principal is the authenticated caller attached to the request context
+type principal struct {
+	Subject string   `json:"subject"`
+	Kind    string   `json:"kind"`
+	Roles   []string `json:"roles,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+
+	// Where the credentials came from, so long lived connections can check they are still good
+	tokenID   string
+	apiKeyID  string
+	expiresAt *time.Time
+}
+
+// actionPolicy says who may run an action. Roles need any one match, scopes need all of them.
+type actionPolicy struct {
+	Public bool
+	Roles  []string
+	Scopes []string
+}
+
+// defaultActionPolicies are the policies for the built-in actions. Actions without a policy need an
+// authenticated caller, but no particular role. API keys get the "service" role and are further limited
+// to the actions in their scopes.
+func defaultActionPolicies() map[string]actionPolicy {
+	return map[string]actionPolicy{
+		"auth": {Public: true},
+		"log":  {Roles: []string{"user", "service"}},
+		"mail": {Roles: []string{"user", "service"}},
+	}
+}
+
+// streamingPaths may pass the access token as ?access_token= instead of a header
+var streamingPaths = map[string]bool{
+	"/events/stream": true,
+	"/ws":            true,
+}
+
+// authenticateRequest validates a bearer token or X-API-Key if one is sent and attaches the caller to the context.
+// Requests without valid credentials carry on anonymously, so a stale token doesn't stop a client refreshing or
+// logging in again. It's up to authorizeAction, requireRole or the handler to decide if anonymous is allowed.
+func (app *Config) authenticateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := app.credentials(r)
+		if err != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authErrorKey, err)))
+			return
+		}
+
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// credentials returns the caller the request's credentials belong to, or nil if it sent none
+func (app *Config) credentials(r *http.Request) (*principal, error) {
+	if plain := r.Header.Get("X-API-Key"); plain != "" {
+		key, err := app.apiKeys.authenticate(plain)
+		if err != nil {
+			return nil, err
+		}
+
+		return &principal{
+			Subject:   "apikey:" + key.Name,
+			Kind:      "apikey",
+			Roles:     []string{"service"},
+			Scopes:    key.Scopes,
+			apiKeyID:  key.ID,
+			expiresAt: key.ExpiresAt,
+		}, nil
+	}
+
+	var raw string
+	if r.Header.Get("Authorization") != "" {
+		var ok bool
+		raw, ok = bearerToken(r)
+		if !ok {
+			return nil, errors.New("malformed Authorization header")
+		}
+	} else if r.Method == http.MethodGet && streamingPaths[r.URL.Path] {
+		// Browsers can't set headers on EventSource or WebSocket connections
+		raw = r.URL.Query().Get("access_token")
+	}
+
+	if raw == "" {
+		return nil, nil
+	}
+
+	claims, err := app.tokens.parse(raw, accessTokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &principal{
+		Subject:   claims.Subject,
+		Kind:      "user",
+		Roles:     claims.Roles,
+		Scopes:    claims.Scopes,
+		tokenID:   claims.ID,
+		expiresAt: &claims.ExpiresAt.Time,
+	}, nil
+}
+
+// recheck returns why p's credentials are no longer good, if they have expired or been revoked since the request
+func (app *Config) recheck(p *principal) error {
+	if p.expiresAt != nil && time.Now().After(*p.expiresAt) {
+		return errors.New("credentials have expired")
+	}
+
+	if p.tokenID != "" && app.tokens.revoked.contains(p.tokenID) {
+		return errors.New("token has been revoked")
+	}
+
+	if p.apiKeyID != "" {
+		return app.apiKeys.check(p.apiKeyID)
+	}
+
+	return nil
+}
+
+// unauthenticated explains why a request has no principal, passing on why its credentials were refused
+func unauthenticated(r *http.Request) error {
+	if err, ok := r.Context().Value(authErrorKey).(error); ok {
+		return fmt.Errorf("%w: %s", errUnauthenticated, err)
+	}
+
+	return errUnauthenticated
+}
+
+// requireRole rejects callers that don't hold the given role
+func (app *Config) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := principalFrom(r.Context())
+			if p == nil {
+				app.errorJson(w, unauthenticated(r), http.StatusUnauthorized)
+				return
+			}
+
+			if !contains(p.Roles, role) {
+				app.errorJson(w, errForbidden, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey).(*principal)
+	return p
+}
+
+// authorizeAction checks the caller against the action's policy, returning the status code to fail with
+func (app *Config) authorizeAction(r *http.Request, action string) (int, error) {
+	policy := app.actions.policy(action)
+	if policy.Public {
+		return http.StatusOK, nil
+	}
+
+	p := principalFrom(r.Context())
+	if p == nil {
+		return http.StatusUnauthorized, unauthenticated(r)
+	}
+
+	if p.Kind == "apikey" && !contains(p.Scopes, action) {
+		return http.StatusForbidden, errForbidden
+	}
+
+	if len(policy.Roles) > 0 && !containsAny(p.Roles, policy.Roles) {
+		return http.StatusForbidden, errForbidden
+	}
+
+	for _, scope := range policy.Scopes {
+		if !contains(p.Scopes, scope) {
+			return http.StatusForbidden, errForbidden
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, w := range wanted {
+		if contains(values, w) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// serviceSettings registers an upstream reachable through /services/{name}/*
+type serviceSettings struct {
+	URL     string `json:"url"`
+	Timeout string `json:"timeout"`
+	// Rewrite replaces a leading path prefix, after /services/{name} has been stripped
+	Rewrite map[string]string `json:"rewrite"`
+	// Credentials sent to the broker are never forwarded, these headers are dropped as well
+	StripRequestHeaders  []string `json:"strip_request_headers"`
+	StripResponseHeaders []string `json:"strip_response_headers"`
+	Public               bool     `json:"public"`
+	Roles                []string `json:"roles"`
+	// Scopes an API key needs, all of them, to use the service. Without any, API keys can't use it at all.
+	Scopes []string `json:"scopes"`
+}
+
+var brokerCredentialHeaders = []string{"Authorization", "X-API-Key", "Cookie"}
+
+type serviceProxy struct {
+	name     string
+	settings serviceSettings
+	proxy    *httputil.ReverseProxy
+}
+
+func newServiceProxies(app *Config) (map[string]*serviceProxy, error) {
+	proxies := map[string]*serviceProxy{}
+
+	for name, s := range app.settings.Services {
+		target, err := url.Parse(s.URL)
+		if err != nil || target.Host == "" {
+			return nil, fmt.Errorf("service %q: invalid url %q", name, s.URL)
+		}
+
+		if s.Timeout == "" {
+			s.Timeout = "10s"
+		}
+
+		timeout, err := time.ParseDuration(s.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: invalid timeout: %w", name, err)
+		}
+
+		sp := &serviceProxy{
+			name:     name,
+			settings: s,
+		}
+
+		sp.proxy = &httputil.ReverseProxy{
+			Director: sp.director(target),
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+				ResponseHeaderTimeout: timeout,
+				IdleConnTimeout:       90 * time.Second,
+			},
+			// Flush straight away so streamed bodies aren't buffered by the broker
+			FlushInterval: -1,
+			ModifyResponse: func(response *http.Response) error {
+				for _, header := range s.StripResponseHeaders {
+					response.Header.Del(header)
+				}
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("::proxy - %s: %s", name, err)
+				app.errorJson(w, fmt.Errorf("error calling %s", name), http.StatusBadGateway)
+			},
+		}
+
+		proxies[name] = sp
+	}
+
+	return proxies, nil
+}
+
+func (sp *serviceProxy) director(target *url.URL) func(r *http.Request) {
+	return func(r *http.Request) {
+		path := "/" + chi.URLParam(r, "*")
+		path = sp.rewrite(path)
+
+		r.URL.Scheme = target.Scheme
+		r.URL.Host = target.Host
+		r.URL.Path = strings.TrimSuffix(target.Path, "/") + path
+		r.URL.RawPath = ""
+		r.Host = target.Host
+
+		for _, header := range append(brokerCredentialHeaders, sp.settings.StripRequestHeaders...) {
+			r.Header.Del(header)
+		}
+
+		r.Header.Del("X-Broker-Subject")
+		if p := principalFrom(r.Context()); p != nil {
+			r.Header.Set("X-Broker-Subject", p.Subject)
+		}
+
+		if _, ok := r.Header["User-Agent"]; !ok {
+			// Stop the default Go user agent being added
+			r.Header.Set("User-Agent", "")
+		}
+	}
+}
+
+// rewrite applies the longest matching prefix rule
+func (sp *serviceProxy) rewrite(path string) string {
+	prefixes := make([]string, 0, len(sp.settings.Rewrite))
+	for prefix := range sp.settings.Rewrite {
+		prefixes = append(prefixes, prefix)
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return sp.settings.Rewrite[prefix] + strings.TrimPrefix(path, prefix)
+		}
+	}
+
+	return path
+}
+
+func (sp *serviceProxy) allowsScopes(scopes []string) bool {
+	if len(sp.settings.Scopes) == 0 {
+		return false
+	}
+
+	for _, scope := range sp.settings.Scopes {
+		if !contains(scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ProxyService forwards /services/{name}/* to the registered upstream, after checking the caller may use it
+func (app *Config) ProxyService(w http.ResponseWriter, r *http.Request) {
+	sp, ok := app.proxies[chi.URLParam(r, "name")]
+	if !ok {
+		app.errorJson(w, errors.New("unknown service"), http.StatusNotFound)
+		return
+	}
+
+	if !sp.settings.Public {
+		p := principalFrom(r.Context())
+		if p == nil {
+			app.errorJson(w, unauthenticated(r), http.StatusUnauthorized)
+			return
+		}
+
+		if len(sp.settings.Roles) > 0 && !containsAny(p.Roles, sp.settings.Roles) {
+			app.errorJson(w, errForbidden, http.StatusForbidden)
+			return
+		}
+
+		if p.Kind == "apikey" && !sp.allowsScopes(p.Scopes) {
+			app.errorJson(w, errForbidden, http.StatusForbidden)
+			return
+		}
+	}
+
+	sp.proxy.ServeHTTP(w, r)
+}
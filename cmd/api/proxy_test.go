@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestServiceProxyScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		service []string
+		key     []string
+		want    bool
+	}{
+		{"no scopes keeps keys out", nil, []string{"log", "mail"}, false},
+		{"matching scope", []string{"services:logger"}, []string{"log", "services:logger"}, true},
+		{"missing scope", []string{"services:logger"}, []string{"log"}, false},
+		{"needs all scopes", []string{"services:logger", "admin"}, []string{"services:logger"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &serviceProxy{settings: serviceSettings{Scopes: tt.service}}
+			if got := sp.allowsScopes(tt.key); got != tt.want {
+				t.Errorf("allowsScopes(%v) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"broker/event"
+	"context"
+	"errors"
+)
+
+var errRabbitUnavailable = errors.New("RabbitMQ is unavailable")
+
+// startConsumer runs consume on a consumer of the current connection, and again on the next
+// connection whenever it stops
+func (app *Config) startConsumer(name string, consume func(consumer *event.Consumer) error) {
+	running := &event.RunningConsumer{Name: name}
+	app.consumers = append(app.consumers, running)
+
+	go func() {
+		_ = app.rabbit.Keep(context.Background(), running, consume)
+	}()
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type rateLimitSettings struct {
+	Enabled bool `json:"enabled"`
+	// Client applies to every request, Actions are checked again once the action is known
+	Client  rateLimitRule            `json:"client"`
+	Actions map[string]rateLimitRule `json:"actions"`
+	// RedisAddr shares the buckets between replicas, leave empty to keep them in memory
+	RedisAddr string `json:"redis_addr"`
+	// TrustForwardedFor keys anonymous clients on X-Forwarded-For, only enable behind a trusted proxy
+	TrustForwardedFor bool `json:"trust_forwarded_for"`
+}
+
+// rateLimitRule is a token bucket that refills Requests tokens every Per and holds up to Burst
+type rateLimitRule struct {
+	Requests int    `json:"requests"`
+	Per      string `json:"per"`
+	Burst    int    `json:"burst,omitempty"`
+}
+
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+type rateLimitStore interface {
+	take(ctx context.Context, key string, capacity int, refillPerSecond float64) (rateLimitResult, error)
+}
+
+type rateLimiter struct {
+	settings rateLimitSettings
+	store    rateLimitStore
+}
+
+func newRateLimiter(s rateLimitSettings) (*rateLimiter, error) {
+	rules := map[string]rateLimitRule{"client": s.Client}
+	for action, rule := range s.Actions {
+		rules["action "+action] = rule
+	}
+
+	for name, rule := range rules {
+		if _, _, err := rule.bucket(); err != nil {
+			return nil, fmt.Errorf("rate limit for %s: %w", name, err)
+		}
+	}
+
+	limiter := &rateLimiter{
+		settings: s,
+		store:    newMemoryRateLimitStore(),
+	}
+
+	if s.RedisAddr != "" {
+		limiter.store = &redisRateLimitStore{
+			client: redis.NewClient(&redis.Options{Addr: s.RedisAddr}),
+		}
+	}
+
+	return limiter, nil
+}
+
+func (rule rateLimitRule) bucket() (int, float64, error) {
+	per, err := time.ParseDuration(rule.Per)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if rule.Requests <= 0 || per <= 0 {
+		return 0, 0, errors.New("requests and per must be positive")
+	}
+
+	capacity := rule.Burst
+	if capacity <= 0 {
+		capacity = rule.Requests
+	}
+
+	return capacity, float64(rule.Requests) / per.Seconds(), nil
+}
+
+// allow takes a token for key under rule, writes the RateLimit headers and, when the bucket is empty, a 429.
+// It fails open if the shared store can't be reached.
+func (app *Config) allow(w http.ResponseWriter, r *http.Request, key string, rule rateLimitRule) bool {
+	capacity, refill, _ := rule.bucket()
+
+	result, err := app.limiter.store.take(r.Context(), key, capacity, refill)
+	if err != nil {
+		log.Println("::allow - rate limit store unavailable:", err)
+		return true
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+		app.errorJson(w, errors.New("rate limit exceeded"), http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// rateLimitClient applies the per client limit to every request
+func (app *Config) rateLimitClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.limiter.settings.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !app.allow(w, r, "client:"+app.clientKey(r), app.limiter.settings.Client) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeClient charges the per client limit for work that doesn't arrive as its own HTTP request, such as
+// WebSocket messages. Like allow, it fails open if the shared store can't be reached.
+func (app *Config) takeClient(r *http.Request) bool {
+	if !app.limiter.settings.Enabled {
+		return true
+	}
+
+	capacity, refill, _ := app.limiter.settings.Client.bucket()
+
+	result, err := app.limiter.store.take(context.Background(), "client:"+app.clientKey(r), capacity, refill)
+	if err != nil {
+		log.Println("::takeClient - rate limit store unavailable:", err)
+		return true
+	}
+
+	return result.Allowed
+}
+
+// allowAction applies the action's own limit, if it has one
+func (app *Config) allowAction(w http.ResponseWriter, r *http.Request, action string) bool {
+	rule, ok := app.limiter.settings.Actions[action]
+	if !app.limiter.settings.Enabled || !ok {
+		return true
+	}
+
+	return app.allow(w, r, "action:"+action+":"+app.clientKey(r), rule)
+}
+
+// clientKey identifies the caller as the API key, the user, or failing that the client IP
+func (app *Config) clientKey(r *http.Request) string {
+	if p := principalFrom(r.Context()); p != nil {
+		if p.Kind == "apikey" {
+			return p.Subject
+		}
+		return "user:" + p.Subject
+	}
+
+	if app.limiter.settings.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return "ip:" + strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// memoryRateLimitStore keeps buckets in this replica only
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	store := &memoryRateLimitStore{
+		buckets: map[string]*memoryBucket{},
+	}
+
+	go store.evictIdle(10 * time.Minute)
+
+	return store
+}
+
+func (s *memoryRateLimitStore) take(ctx context.Context, key string, capacity int, refillPerSecond float64) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(capacity), updated: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(capacity), b.tokens+now.Sub(b.updated).Seconds()*refillPerSecond)
+	b.updated = now
+
+	return spendToken(&b.tokens, capacity, refillPerSecond), nil
+}
+
+// evictIdle drops buckets that have not been touched for a while, by then they would be full anyway
+func (s *memoryRateLimitStore) evictIdle(idle time.Duration) {
+	for range time.Tick(idle) {
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if time.Since(b.updated) > idle {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func spendToken(tokens *float64, capacity int, refillPerSecond float64) rateLimitResult {
+	result := rateLimitResult{
+		Limit: capacity,
+	}
+
+	if *tokens >= 1 {
+		*tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - *tokens) / refillPerSecond)
+	}
+
+	result.Remaining = int(*tokens)
+	result.Reset = secondsToDuration((float64(capacity) - *tokens) / refillPerSecond)
+
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// The bucket is refilled and spent inside Redis so concurrent replicas can't race each other
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local refill = tonumber(ARGV[2])
+local now = redis.call("TIME")
+local nowSeconds = tonumber(now[1]) + tonumber(now[2]) / 1000000
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or capacity
+local updated = tonumber(bucket[2]) or nowSeconds
+
+tokens = math.min(capacity, tokens + (nowSeconds - updated) * refill)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(nowSeconds))
+redis.call("EXPIRE", KEYS[1], math.ceil(capacity / refill) + 1)
+
+return {allowed, tostring(tokens)}
+`)
+
+// redisRateLimitStore shares buckets between every replica using the same Redis
+type redisRateLimitStore struct {
+	client *redis.Client
+}
+
+func (s *redisRateLimitStore) take(ctx context.Context, key string, capacity int, refillPerSecond float64) (rateLimitResult, error) {
+	values, err := tokenBucketScript.Run(ctx, s.client, []string{"ratelimit:" + key}, capacity, refillPerSecond).Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	if len(values) != 2 {
+		return rateLimitResult{}, errors.New("unexpected reply from rate limit script")
+	}
+
+	tokens, err := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	result := rateLimitResult{
+		Allowed:   values[0] == int64(1),
+		Limit:     capacity,
+		Remaining: int(tokens),
+		Reset:     secondsToDuration((float64(capacity) - tokens) / refillPerSecond),
+	}
+
+	if !result.Allowed {
+		result.RetryAfter = secondsToDuration((1 - tokens) / refillPerSecond)
+	}
+
+	return result, nil
+}
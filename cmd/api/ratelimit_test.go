@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRateLimitRuleBucket(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         rateLimitRule
+		wantCapacity int
+		wantRefill   float64
+		wantErr      bool
+	}{
+		{"per minute", rateLimitRule{Requests: 60, Per: "1m"}, 60, 1, false},
+		{"burst overrides capacity", rateLimitRule{Requests: 20, Per: "1s", Burst: 40}, 40, 20, false},
+		{"bad duration", rateLimitRule{Requests: 1, Per: "soon"}, 0, 0, true},
+		{"no requests", rateLimitRule{Requests: 0, Per: "1s"}, 0, 0, true},
+		{"negative period", rateLimitRule{Requests: 1, Per: "-1s"}, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capacity, refill, err := tt.rule.bucket()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if capacity != tt.wantCapacity || refill != tt.wantRefill {
+				t.Errorf("bucket() = %d, %v, want %d, %v", capacity, refill, tt.wantCapacity, tt.wantRefill)
+			}
+		})
+	}
+}
+
+func TestRateLimitStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	stores := map[string]rateLimitStore{
+		"memory": newMemoryRateLimitStore(),
+		"redis":  &redisRateLimitStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			// 3 tokens refilling one every 100 seconds, so nothing refills during the test
+			for i := 0; i < 3; i++ {
+				result, err := store.take(ctx, "client:a", 3, 0.01)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Allowed || result.Remaining != 2-i || result.Limit != 3 {
+					t.Fatalf("take %d = %+v, want allowed with %d remaining", i, result, 2-i)
+				}
+			}
+
+			result, err := store.take(ctx, "client:a", 3, 0.01)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed || result.RetryAfter <= 0 || result.Reset <= 0 {
+				t.Fatalf("take on an empty bucket = %+v, want refused with retry and reset times", result)
+			}
+
+			// Buckets are per key
+			result, err = store.take(ctx, "client:b", 3, 0.01)
+			if err != nil || !result.Allowed {
+				t.Fatalf("take for another key = %+v, %v, want allowed", result, err)
+			}
+		})
+	}
+}
+
+func newRateLimitedApp(t *testing.T, s rateLimitSettings) *Config {
+	t.Helper()
+
+	limiter, err := newRateLimiter(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Config{limiter: limiter}
+}
+
+func TestRateLimitClient(t *testing.T) {
+	app := newRateLimitedApp(t, rateLimitSettings{
+		Enabled: true,
+		Client:  rateLimitRule{Requests: 2, Per: "1h"},
+	})
+
+	handler := app.rateLimitClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	wantStatus := []int{http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests}
+	for i, want := range wantStatus {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/actions", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+
+		handler.ServeHTTP(rr, r)
+
+		if rr.Code != want {
+			t.Fatalf("request %d: status %d, want %d", i, rr.Code, want)
+		}
+		if rr.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("request %d: RateLimit-Limit = %q, want 2", i, rr.Header().Get("RateLimit-Limit"))
+		}
+		if want == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: 429 without Retry-After", i)
+		}
+	}
+
+	// A different client has its own bucket
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/actions", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	handler.ServeHTTP(rr, r)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("other client: status %d, want %d", rr.Code, http.StatusNoContent)
+	}
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	app := newRateLimitedApp(t, rateLimitSettings{
+		Enabled:   true,
+		Client:    rateLimitRule{Requests: 1, Per: "1h"},
+		RedisAddr: mr.Addr(),
+	})
+	app.limiter.store.(*redisRateLimitStore).client.Options().DialTimeout = 100 * time.Millisecond
+	mr.Close()
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/actions", nil)
+
+	if !app.allow(rr, r, "client:x", app.limiter.settings.Client) {
+		t.Fatal("allow refused a request while Redis was down, it should fail open")
+	}
+}
@@ -1,31 +1,59 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 )
 
 func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 
-	// Who is allowed to connect?
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	// Who is allowed to connect? Comes from the cors settings, see cors.go
+	mux.Use(app.cors)
 
 	mux.Use(middleware.Heartbeat("/ping"))
+	mux.Use(app.authenticateRequest)
+	mux.Use(app.rateLimitClient)
+
+	mux.Get("/healthz/live", app.HealthLive)
+	mux.Get("/healthz/ready", app.HealthReady)
 
 	mux.Post("/", app.Broker)
-	mux.Post("/handle", app.HandleSubmission)
+	mux.With(app.idempotent).Post("/handle", app.HandleSubmission)
+	mux.Post("/handle/batch", app.HandleBatch)
+	mux.Get("/actions", app.ListActions)
+	mux.Post("/auth/refresh", app.RefreshToken)
+	mux.Post("/auth/logout", app.Logout)
 	mux.Post("/log-grpc", app.logItemViaGrpc)
+	mux.Get("/jobs/{id}", app.GetJob)
+	mux.HandleFunc("/services/{name}/*", app.ProxyService)
+	mux.Get("/events/stream", app.StreamEvents)
+	mux.Get("/ws", app.WebSocket)
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.requireRole("admin"))
+
+		mux.Get("/api-keys", app.ListApiKeys)
+		mux.Post("/api-keys", app.CreateApiKey)
+		mux.Delete("/api-keys/{id}", app.RevokeApiKey)
+
+		mux.Get("/webhooks", app.ListWebhooks)
+		mux.Post("/webhooks", app.CreateWebhook)
+		mux.Delete("/webhooks/{id}", app.DeleteWebhook)
+		mux.Post("/webhooks/{id}/enable", app.EnableWebhook)
+		mux.Get("/webhooks/{id}/deliveries", app.ListWebhookDeliveries)
+
+		mux.Get("/mail/scheduled", app.ListScheduledMail)
+		mux.Delete("/mail/scheduled/{id}", app.CancelScheduledMail)
+
+		mux.Get("/topology", app.GetTopology)
+		mux.Post("/topology", app.ApplyTopology)
+
+		mux.Get("/metrics", expvar.Handler().ServeHTTP)
+	})
 
 	return mux
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var errScheduledMailNotFound = errors.New("scheduled mail not found")
+
+// scheduledMail is a mail held back until SendAt
+type scheduledMail struct {
+	ID        string      `json:"id"`
+	SendAt    time.Time   `json:"send_at"`
+	Mail      MailPayload `json:"mail"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"last_error,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// mailScheduler keeps pending mail in memory, persisted to a JSON file if it has a path, and hands each one
+// to deliver once it is due. Failed deliveries are tried again after retryAfter.
+type mailScheduler struct {
+	mu          sync.Mutex
+	path        string
+	pending     map[string]*scheduledMail
+	retryAfter  time.Duration
+	timeout     time.Duration
+	maxAttempts int
+	deliver     func(ctx context.Context, msg MailPayload) error
+	wake        chan struct{}
+}
+
+func newMailScheduler(s mailSettings, deliver func(ctx context.Context, msg MailPayload) error) (*mailScheduler, error) {
+	retryAfter, err := time.ParseDuration(s.ScheduleRetry)
+	if err != nil || retryAfter <= 0 {
+		return nil, fmt.Errorf("invalid mail schedule_retry %q", s.ScheduleRetry)
+	}
+
+	timeout, err := time.ParseDuration(s.ScheduleTimeout)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid mail schedule_timeout %q", s.ScheduleTimeout)
+	}
+
+	if s.ScheduleMaxAttempts <= 0 {
+		return nil, errors.New("mail schedule_max_attempts must be positive")
+	}
+
+	scheduler := &mailScheduler{
+		path:        s.ScheduleStore,
+		pending:     map[string]*scheduledMail{},
+		retryAfter:  retryAfter,
+		timeout:     timeout,
+		maxAttempts: s.ScheduleMaxAttempts,
+		deliver:     deliver,
+		wake:        make(chan struct{}, 1),
+	}
+
+	if s.ScheduleStore == "" {
+		log.Println("mail schedule_store not set, scheduled mail will be lost on restart")
+		return scheduler, nil
+	}
+
+	data, err := os.ReadFile(s.ScheduleStore)
+	if errors.Is(err, os.ErrNotExist) {
+		return scheduler, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var pending []*scheduledMail
+	err = json.Unmarshal(data, &pending)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sm := range pending {
+		scheduler.pending[sm.ID] = sm
+	}
+
+	return scheduler, nil
+}
+
+func (s *mailScheduler) schedule(msg MailPayload, sendAt time.Time) (scheduledMail, error) {
+	sm := &scheduledMail{
+		ID:        randomId(8),
+		SendAt:    sendAt,
+		Mail:      msg,
+		CreatedAt: time.Now(),
+	}
+
+	s.mu.Lock()
+	s.pending[sm.ID] = sm
+	err := s.saveLocked()
+	s.mu.Unlock()
+
+	s.poke()
+
+	return *sm, err
+}
+
+func (s *mailScheduler) list() []scheduledMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := make([]scheduledMail, 0, len(s.pending))
+	for _, sm := range s.pending {
+		pending = append(pending, *sm)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].SendAt.Before(pending[j].SendAt)
+	})
+
+	return pending
+}
+
+func (s *mailScheduler) cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[id]; !ok {
+		return errScheduledMailNotFound
+	}
+
+	delete(s.pending, id)
+
+	return s.saveLocked()
+}
+
+// poke makes run look at the schedule again
+func (s *mailScheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers mail as it falls due, it never returns
+func (s *mailScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		next := s.deliverDue()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// deliverDue sends everything that is due and returns how long until the next mail is
+func (s *mailScheduler) deliverDue() time.Duration {
+	now := time.Now()
+
+	s.mu.Lock()
+	var due []scheduledMail
+	for _, sm := range s.pending {
+		if !sm.SendAt.After(now) {
+			due = append(due, *sm)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sm := range due {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		err := s.deliver(ctx, sm.Mail)
+		cancel()
+
+		s.finish(sm.ID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := time.Hour
+	for _, sm := range s.pending {
+		if wait := time.Until(sm.SendAt); wait < next {
+			next = wait
+		}
+	}
+
+	if next < 0 {
+		next = 0
+	}
+
+	return next
+}
+
+func (s *mailScheduler) finish(id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sm, ok := s.pending[id]
+	if !ok {
+		// Cancelled while it was being delivered
+		return
+	}
+
+	sm.Attempts++
+
+	switch {
+	case err == nil:
+		delete(s.pending, id)
+	case sm.Attempts >= s.maxAttempts:
+		log.Printf("::mailScheduler - giving up on %s after %d attempts: %s", id, sm.Attempts, err)
+		delete(s.pending, id)
+	default:
+		log.Printf("::mailScheduler - delivery of %s failed, retrying in %s: %s", id, s.retryAfter, err)
+		sm.LastError = err.Error()
+		sm.SendAt = time.Now().Add(s.retryAfter)
+	}
+
+	saveErr := s.saveLocked()
+	if saveErr != nil {
+		log.Println("::mailScheduler - unable to save schedule:", saveErr)
+	}
+}
+
+func (s *mailScheduler) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	pending := make([]*scheduledMail, 0, len(s.pending))
+	for _, sm := range s.pending {
+		pending = append(pending, sm)
+	}
+
+	data, err := json.MarshalIndent(pending, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, ".mail-schedule-", data)
+}
+
+// sendAt works out when a mail with send_at or delay should go out
+func (msg MailPayload) sendAt() (time.Time, bool) {
+	if msg.SendAt != nil {
+		return *msg.SendAt, true
+	}
+
+	if msg.Delay != "" {
+		delay, _ := time.ParseDuration(msg.Delay)
+		return time.Now().Add(delay), true
+	}
+
+	return time.Time{}, false
+}
+
+// scheduleMail holds a mail back until it is due
+func (app *Config) scheduleMail(w http.ResponseWriter, msg MailPayload, sendAt time.Time) {
+	msg.SendAt = nil
+	msg.Delay = ""
+
+	sm, err := app.mailScheduler.schedule(msg, sendAt)
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("::scheduleMail - %s to '%s' scheduled for %s", sm.ID, msg.To, sm.SendAt.Format(time.RFC3339))
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "mail scheduled"
+	payloadResponse.Data = map[string]any{"id": sm.ID, "send_at": sm.SendAt}
+
+	app.writeJson(w, http.StatusAccepted, payloadResponse)
+}
+
+// deliverScheduledMail sends a due mail down the normal mail path
+func (app *Config) deliverScheduledMail(ctx context.Context, msg MailPayload) error {
+	rec := newResponseRecorder()
+	app.sendMailContext(ctx, rec, msg)
+
+	if rec.status != http.StatusAccepted {
+		var response jsonResponse
+		_ = json.Unmarshal(rec.body.Bytes(), &response)
+		return fmt.Errorf("mail returned %d: %s", rec.status, response.Message)
+	}
+
+	return nil
+}
+
+func (app *Config) ListScheduledMail(w http.ResponseWriter, r *http.Request) {
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "scheduled mail"
+	payloadResponse.Data = app.mailScheduler.list()
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+func (app *Config) CancelScheduledMail(w http.ResponseWriter, r *http.Request) {
+	err := app.mailScheduler.cancel(chi.URLParam(r, "id"))
+	if errors.Is(err, errScheduledMailNotFound) {
+		app.errorJson(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "scheduled mail cancelled"
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testMailSettings() mailSettings {
+	return mailSettings{
+		ScheduleRetry:       "1h",
+		ScheduleMaxAttempts: 2,
+		ScheduleTimeout:     "20ms",
+	}
+}
+
+func TestScheduledDeliveryTimesOut(t *testing.T) {
+	scheduler, err := newMailScheduler(testMailSettings(), func(ctx context.Context, msg MailPayload) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm, err := scheduler.schedule(MailPayload{To: "ann@example.com", Subject: "hi"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		scheduler.deliverDue()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliverDue is stuck behind a send that never finishes")
+	}
+
+	pending := scheduler.list()
+	if len(pending) != 1 || pending[0].ID != sm.ID || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("pending = %+v, want the mail kept for a retry with the timeout recorded", pending)
+	}
+}
+
+func TestScheduleSurvivesRestart(t *testing.T) {
+	s := testMailSettings()
+	s.ScheduleStore = filepath.Join(t.TempDir(), "mail-schedule.json")
+
+	deliver := func(ctx context.Context, msg MailPayload) error { return nil }
+
+	scheduler, err := newMailScheduler(s, deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm, err := scheduler.schedule(MailPayload{To: "ann@example.com", Subject: "later"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := newMailScheduler(s, deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := restarted.list(); len(pending) != 1 || pending[0].ID != sm.ID {
+		t.Fatalf("after a restart pending = %+v, want %s", pending, sm.ID)
+	}
+}
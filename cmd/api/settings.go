@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// settings is the broker's structured configuration, read from the JSON file named by BROKER_CONFIG.
+// Secrets such as signing keys stay in environment variables.
+type settings struct {
+	RateLimits  rateLimitSettings   `json:"rate_limits"`
+	CORS        corsSettings        `json:"cors"`
+	Jobs        jobSettings         `json:"jobs"`
+	Batch       batchSettings       `json:"batch"`
+	Idempotency idempotencySettings `json:"idempotency"`
+	// ForwardActions are served generically alongside the hand-written actions, see forward.go
+	ForwardActions []forwardSettings `json:"forward_actions"`
+	// Services are reverse proxied under /services/{name}/*, see proxy.go. None are by default,
+	// as proxying goes around the action policies and rate limits, so each has to be opted in.
+	Services  map[string]serviceSettings `json:"services"`
+	Stream    streamSettings             `json:"stream"`
+	WebSocket websocketSettings          `json:"websocket"`
+	Webhooks  webhookSettings            `json:"webhooks"`
+	Mail      mailSettings               `json:"mail"`
+	Events    eventSettings              `json:"events"`
+	Logs      logSettings                `json:"logs"`
+}
+
+type eventSettings struct {
+	// Format is "plain", "cloudevents-binary" or "cloudevents-structured". Consumers read all three.
+	Format string `json:"format"`
+	// Topology names a file declaring the exchanges, queues and bindings to apply at startup
+	Topology string `json:"topology"`
+	// Outbox is a directory events are written to before a relay publishes them, so they survive
+	// RabbitMQ outages. Put it on a persistent volume to survive restarts too. Empty publishes directly,
+	// failing while RabbitMQ is down.
+	Outbox string `json:"outbox"`
+	// OutboxGrace is how long the outbox relay may go without reaching RabbitMQ before the broker
+	// reports itself unready, so a pod cut off for good is taken out of service
+	OutboxGrace string `json:"outbox_grace"`
+}
+
+func (s eventSettings) validate() (time.Duration, error) {
+	grace, err := time.ParseDuration(s.OutboxGrace)
+	if err != nil || grace <= 0 {
+		return 0, fmt.Errorf("invalid events outbox_grace %q", s.OutboxGrace)
+	}
+
+	return grace, nil
+}
+
+func defaultSettings() settings {
+	return settings{
+		RateLimits: rateLimitSettings{
+			Enabled: true,
+			Client:  rateLimitRule{Requests: 300, Per: "1m"},
+			Actions: map[string]rateLimitRule{
+				"auth": {Requests: 10, Per: "1m"},
+				"mail": {Requests: 20, Per: "1m"},
+			},
+		},
+		CORS: defaultCorsSettings(),
+		Jobs: jobSettings{
+			Workers:   4,
+			QueueSize: 100,
+			Retention: "1h",
+		},
+		Batch: batchSettings{
+			MaxItems:    50,
+			MaxBytes:    4 << 20,
+			Concurrency: 5,
+		},
+		Idempotency: idempotencySettings{
+			TTL: "24h",
+		},
+		Stream: streamSettings{
+			History:      500,
+			ClientBuffer: 64,
+			Heartbeat:    "15s",
+			// mail.* carries addresses and message bodies, so it is left to admins
+			Access: map[string][]string{
+				"role:admin":   {"#"},
+				"role:user":    {"log.#"},
+				"role:service": {"log.#"},
+			},
+		},
+		WebSocket: websocketSettings{
+			RateLimit:   rateLimitRule{Requests: 20, Per: "1s", Burst: 40},
+			MaxInFlight: 8,
+			PingPeriod:  "30s",
+			MaxFrame:    1048576,
+		},
+		Webhooks: webhookSettings{
+			Queue:          "webhooks",
+			Timeout:        "10s",
+			MaxAttempts:    5,
+			InitialBackoff: "1s",
+			MaxBackoff:     "1m",
+			DisableAfter:   10,
+			Concurrency:    20,
+			QueueSize:      1000,
+			DeliveryLog:    50,
+		},
+		// One queue takes every log event so the log action's events reach logger-service
+		// without any configuration. Config files replace the list as a whole.
+		Logs: logSettings{
+			Consumers: []logConsumerSettings{
+				{Queue: "logs", Topics: []string{"log.#"}, Concurrency: 4},
+			},
+		},
+		Mail: mailSettings{
+			Mode:                "sync",
+			Consumer:            true,
+			Queue:               "mail_send",
+			Concurrency:         4,
+			ScheduleRetry:       "1m",
+			ScheduleMaxAttempts: 5,
+			ScheduleTimeout:     "30s",
+		},
+		Events: eventSettings{
+			Format:      "plain",
+			OutboxGrace: "5m",
+		},
+	}
+}
+
+// loadSettings overlays the config file, if there is one, on top of the defaults
+func loadSettings(path string) (settings, error) {
+	s := defaultSettings()
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
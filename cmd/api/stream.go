@@ -0,0 +1,319 @@
+package main
+
+import (
+	"broker/event"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type streamSettings struct {
+	// History is how many recent events are kept for Last-Event-ID resume
+	History int `json:"history"`
+	// ClientBuffer is how many events a client may fall behind before it is disconnected
+	ClientBuffer int    `json:"client_buffer"`
+	Heartbeat    string `json:"heartbeat"`
+	// Access lists the topic patterns each "role:<name>" or "scope:<name>" may see, callers get the patterns of
+	// all their roles and scopes. Events on any other topic are never sent to them, whatever they subscribe to.
+	Access map[string][]string `json:"access"`
+}
+
+type streamEvent struct {
+	ID    uint64
+	Topic string
+	Data  []byte
+}
+
+type streamSubscriber struct {
+	patterns []string
+	// allowed is the caller's topic access, see streamSettings.Access
+	allowed []string
+	events  chan streamEvent
+	// slow is closed when the subscriber falls too far behind and has been dropped
+	slow chan struct{}
+}
+
+func (sub *streamSubscriber) wants(topic string) bool {
+	return matchesAny(sub.patterns, topic) && matchesAny(sub.allowed, topic)
+}
+
+func matchesAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if event.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventHub fans logs_topic events out to stream subscribers and keeps a short history
+type eventHub struct {
+	mu           sync.Mutex
+	nextID       uint64
+	history      []streamEvent
+	historySize  int
+	clientBuffer int
+	heartbeat    time.Duration
+	subscribers  map[*streamSubscriber]struct{}
+}
+
+func newEventHub(s streamSettings) (*eventHub, error) {
+	heartbeat, err := time.ParseDuration(s.Heartbeat)
+	if err != nil || heartbeat <= 0 {
+		return nil, fmt.Errorf("invalid stream heartbeat %q", s.Heartbeat)
+	}
+
+	if s.History < 0 || s.ClientBuffer <= 0 {
+		return nil, errors.New("stream history can't be negative and client_buffer must be positive")
+	}
+
+	hub := &eventHub{
+		nextID:       1,
+		historySize:  s.History,
+		clientBuffer: s.ClientBuffer,
+		heartbeat:    heartbeat,
+		subscribers:  map[*streamSubscriber]struct{}{},
+	}
+
+	return hub, nil
+}
+
+// publish is the event.Handler fed by the hub's consumer
+func (hub *eventHub) publish(msg event.Message) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	e := streamEvent{
+		ID:    hub.nextID,
+		Topic: msg.RoutingKey,
+		Data:  msg.Body,
+	}
+	hub.nextID++
+
+	hub.history = append(hub.history, e)
+	if len(hub.history) > hub.historySize {
+		hub.history = hub.history[len(hub.history)-hub.historySize:]
+	}
+
+	for sub := range hub.subscribers {
+		if !sub.wants(e.Topic) {
+			continue
+		}
+
+		select {
+		case sub.events <- e:
+		default:
+			// Never let one slow client hold up everyone else
+			delete(hub.subscribers, sub)
+			close(sub.slow)
+		}
+	}
+}
+
+// subscribe registers for patterns, limited to the allowed topics, and returns the buffered events after lastID that match
+func (hub *eventHub) subscribe(patterns, allowed []string, lastID uint64) (*streamSubscriber, []streamEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	sub := &streamSubscriber{
+		patterns: patterns,
+		allowed:  allowed,
+		events:   make(chan streamEvent, hub.clientBuffer),
+		slow:     make(chan struct{}),
+	}
+
+	var backlog []streamEvent
+	if lastID > 0 {
+		for _, e := range hub.history {
+			if e.ID > lastID && sub.wants(e.Topic) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	hub.subscribers[sub] = struct{}{}
+
+	return sub, backlog
+}
+
+// updatePatterns adds or removes topic patterns for a live subscriber and returns the patterns it now has
+func (hub *eventHub) updatePatterns(sub *streamSubscriber, patterns []string, add bool) []string {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	var updated []string
+	for _, existing := range sub.patterns {
+		if !contains(patterns, existing) {
+			updated = append(updated, existing)
+		}
+	}
+
+	if add {
+		updated = append(updated, patterns...)
+	}
+
+	sub.patterns = updated
+
+	return append([]string{}, updated...)
+}
+
+func (hub *eventHub) unsubscribe(sub *streamSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	delete(hub.subscribers, sub)
+}
+
+func validTopicPattern(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+
+	for _, word := range strings.Split(pattern, ".") {
+		if word == "" || (strings.ContainsAny(word, "*#") && word != "*" && word != "#") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// topicPatterns reads ?topic= filters, defaulting to every topic the caller is allowed to see
+func topicPatterns(r *http.Request, allowed []string) ([]string, int, error) {
+	patterns := r.URL.Query()["topic"]
+	if len(patterns) == 0 {
+		return []string{"#"}, http.StatusOK, nil
+	}
+
+	for _, pattern := range patterns {
+		if !validTopicPattern(pattern) {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid topic pattern %q", pattern)
+		}
+
+		if !topicReachable(pattern, allowed) {
+			return nil, http.StatusForbidden, fmt.Errorf("not allowed to subscribe to %q", pattern)
+		}
+	}
+
+	return patterns, http.StatusOK, nil
+}
+
+// topicAccess returns the topic patterns p may see, from the stream access settings
+func (app *Config) topicAccess(p *principal) []string {
+	var allowed []string
+
+	for _, role := range p.Roles {
+		allowed = append(allowed, app.settings.Stream.Access["role:"+role]...)
+	}
+
+	for _, scope := range p.Scopes {
+		allowed = append(allowed, app.settings.Stream.Access["scope:"+scope]...)
+	}
+
+	return allowed
+}
+
+// topicReachable reports whether any topic matching pattern is one of the allowed ones
+func topicReachable(pattern string, allowed []string) bool {
+	for _, a := range allowed {
+		if patternsOverlap(strings.Split(pattern, "."), strings.Split(a, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// patternsOverlap reports whether some topic matches both patterns
+func patternsOverlap(a, b []string) bool {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return true
+	case len(a) > 0 && a[0] == "#":
+		return patternsOverlap(a[1:], b) || (len(b) > 0 && patternsOverlap(a, b[1:]))
+	case len(b) > 0 && b[0] == "#":
+		return patternsOverlap(a, b[1:]) || (len(a) > 0 && patternsOverlap(a[1:], b))
+	case len(a) == 0 || len(b) == 0:
+		return false
+	case a[0] == b[0] || a[0] == "*" || b[0] == "*":
+		return patternsOverlap(a[1:], b[1:])
+	}
+
+	return false
+}
+
+// StreamEvents serves logs_topic events as Server-Sent Events
+func (app *Config) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if principalFrom(r.Context()) == nil {
+		app.errorJson(w, unauthenticated(r), http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.errorJson(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	allowed := app.topicAccess(principalFrom(r.Context()))
+
+	patterns, status, err := topicPatterns(r, allowed)
+	if err != nil {
+		app.errorJson(w, err, status)
+		return
+	}
+
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	sub, backlog := app.hub.subscribe(patterns, allowed, lastID)
+	defer app.hub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	for _, e := range backlog {
+		writeStreamEvent(w, e)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(app.hub.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.slow:
+			fmt.Fprintf(w, ": disconnected, client too slow\n\n")
+			flusher.Flush()
+			return
+		case <-ticker.C:
+			fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		case e := <-sub.events:
+			writeStreamEvent(w, e)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, e streamEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\n", e.ID, e.Topic)
+
+	// Multi-line bodies need one data field per line
+	for _, line := range bytes.Split(e.Data, []byte("\n")) {
+		fmt.Fprintf(w, "data: %s\n", bytes.TrimRight(line, "\r"))
+	}
+
+	fmt.Fprintf(w, "\n")
+}
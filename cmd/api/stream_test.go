@@ -0,0 +1,62 @@
+package main
+
+import (
+	"broker/event"
+	"testing"
+)
+
+func TestTopicReachable(t *testing.T) {
+	userAccess := []string{"log.#"}
+
+	tests := []struct {
+		pattern string
+		allowed []string
+		want    bool
+	}{
+		{"#", userAccess, true},
+		{"log.ERROR", userAccess, true},
+		{"*.ERROR", userAccess, true},
+		{"log.*.billing", userAccess, true},
+		{"mail.*", userAccess, false},
+		{"mail.send", userAccess, false},
+		{"audit", userAccess, false},
+		{"mail.*", []string{"#"}, true},
+		{"mail.send", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := topicReachable(tt.pattern, tt.allowed); got != tt.want {
+			t.Errorf("topicReachable(%q, %v) = %v, want %v", tt.pattern, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestHubOnlyDeliversAllowedTopics(t *testing.T) {
+	hub, err := newEventHub(streamSettings{History: 10, ClientBuffer: 10, Heartbeat: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := hub.subscribe([]string{"#"}, []string{"log.#"}, 0)
+	admin, _ := hub.subscribe([]string{"#"}, []string{"#"}, 0)
+
+	for _, topic := range []string{"log.INFO", event.MailSendTopic} {
+		hub.publish(event.Message{Event: event.Event{RoutingKey: topic}})
+	}
+
+	if len(user.events) != 1 || (<-user.events).Topic != "log.INFO" {
+		t.Errorf("user subscribed to # should only see log.INFO")
+	}
+
+	if len(admin.events) != 2 {
+		t.Errorf("admin got %d events, want 2", len(admin.events))
+	}
+
+	// Resuming from history is filtered too
+	_, backlog := hub.subscribe([]string{"#"}, []string{"log.#"}, 1)
+	for _, e := range backlog {
+		if e.Topic == event.MailSendTopic {
+			t.Errorf("history replayed %s to a user", e.Topic)
+		}
+	}
+}
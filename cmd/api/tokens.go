@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
+
+// tokenIssuer signs and verifies the broker's session tokens.
+// Every configured key can verify, only the active key signs, so keys can be
+// rotated by adding a new key, making it active and dropping the old one once
+// its refresh tokens have expired.
+type tokenIssuer struct {
+	issuer     string
+	keys       map[string][]byte
+	activeKey  string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	revoked    *revocationList
+}
+
+type tokenClaims struct {
+	Type   string   `json:"typ"`
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type refreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newTokenIssuerFromEnv reads JWT_SIGNING_KEYS as a comma separated list of kid:secret pairs.
+// JWT_ACTIVE_KEY picks the signing key, defaulting to the first one listed.
+func newTokenIssuerFromEnv() (*tokenIssuer, error) {
+	issuer := &tokenIssuer{
+		issuer:  envOrDefault("JWT_ISSUER", "broker-service"),
+		keys:    map[string][]byte{},
+		revoked: newRevocationList(),
+	}
+
+	var err error
+	issuer.accessTTL, err = time.ParseDuration(envOrDefault("JWT_ACCESS_TTL", "15m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_ACCESS_TTL: %w", err)
+	}
+
+	issuer.refreshTTL, err = time.ParseDuration(envOrDefault("JWT_REFRESH_TTL", "168h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_REFRESH_TTL: %w", err)
+	}
+
+	for _, pair := range strings.Split(os.Getenv("JWT_SIGNING_KEYS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kid, secret, found := strings.Cut(pair, ":")
+		if !found || kid == "" || secret == "" {
+			return nil, errors.New("JWT_SIGNING_KEYS entries must look like kid:secret")
+		}
+
+		issuer.keys[kid] = []byte(secret)
+		if issuer.activeKey == "" {
+			issuer.activeKey = kid
+		}
+	}
+
+	if len(issuer.keys) == 0 {
+		// Tokens from a random key don't survive a restart or work across replicas,
+		// so it is only allowed when asked for
+		if os.Getenv("BROKER_ENV") != "development" && os.Getenv("JWT_EPHEMERAL_KEY") != "true" {
+			return nil, errors.New("JWT_SIGNING_KEYS is required, set BROKER_ENV=development or JWT_EPHEMERAL_KEY=true to use a random key")
+		}
+
+		log.Println("JWT_SIGNING_KEYS not set, using a random signing key")
+		issuer.keys["ephemeral"] = []byte(randomId(32))
+		issuer.activeKey = "ephemeral"
+	}
+
+	if active := os.Getenv("JWT_ACTIVE_KEY"); active != "" {
+		if _, ok := issuer.keys[active]; !ok {
+			return nil, fmt.Errorf("JWT_ACTIVE_KEY %q is not one of JWT_SIGNING_KEYS", active)
+		}
+		issuer.activeKey = active
+	}
+
+	return issuer, nil
+}
+
+func (t *tokenIssuer) issuePair(subject string, roles, scopes []string) (tokenPair, error) {
+	access, err := t.sign(subject, roles, scopes, accessTokenType, t.accessTTL)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refresh, err := t.sign(subject, roles, scopes, refreshTokenType, t.refreshTTL)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(t.accessTTL.Seconds()),
+	}, nil
+}
+
+func (t *tokenIssuer) sign(subject string, roles, scopes []string, tokenType string, ttl time.Duration) (string, error) {
+	now := time.Now()
+
+	claims := tokenClaims{
+		Type:   tokenType,
+		Roles:  roles,
+		Scopes: scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomId(16),
+			Issuer:    t.issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = t.activeKey
+
+	return token.SignedString(t.keys[t.activeKey])
+}
+
+// parse verifies signature, expiry, issuer, token type and revocation
+func (t *tokenIssuer) parse(raw string, tokenType string) (*tokenClaims, error) {
+	var claims tokenClaims
+
+	_, err := jwt.ParseWithClaims(raw, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := t.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(t.issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != tokenType {
+		return nil, fmt.Errorf("expected %s token", tokenType)
+	}
+
+	if t.revoked.contains(claims.ID) {
+		return nil, errors.New("token has been revoked")
+	}
+
+	return &claims, nil
+}
+
+func (t *tokenIssuer) revoke(claims *tokenClaims) {
+	t.revoked.add(claims.ID, claims.ExpiresAt.Time)
+}
+
+// use revokes a single-use token, returning false if it had already been revoked
+func (t *tokenIssuer) use(claims *tokenClaims) bool {
+	return t.revoked.revokeIfUnused(claims.ID, claims.ExpiresAt.Time)
+}
+
+// RefreshToken swaps a refresh token for a new pair. The old refresh token is revoked so it can only be used once.
+func (app *Config) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var requestPayload refreshPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	claims, err := app.tokens.parse(requestPayload.RefreshToken, refreshTokenType)
+	if err != nil {
+		app.errorJson(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	// Concurrent refreshes with the same token all pass parse, only one of them gets to use it
+	if !app.tokens.use(claims) {
+		app.errorJson(w, errors.New("token has been revoked"), http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := app.tokens.issuePair(claims.Subject, claims.Roles, claims.Scopes)
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "token refreshed"
+	payloadResponse.Data = tokens
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+// Logout revokes the refresh token in the body and, if sent, the bearer access token
+func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	var requestPayload refreshPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	claims, err := app.tokens.parse(requestPayload.RefreshToken, refreshTokenType)
+	if err != nil {
+		app.errorJson(w, err, http.StatusUnauthorized)
+		return
+	}
+	app.tokens.revoke(claims)
+
+	if raw, ok := bearerToken(r); ok {
+		if accessClaims, err := app.tokens.parse(raw, accessTokenType); err == nil {
+			app.tokens.revoke(accessClaims)
+		}
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "logged out"
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// revocationList remembers revoked token IDs until the tokens would have expired anyway
+type revocationList struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		entries: map[string]time.Time{},
+	}
+}
+
+func (l *revocationList) add(id string, expiresAt time.Time) {
+	l.revokeIfUnused(id, expiresAt)
+}
+
+// revokeIfUnused revokes id and reports whether it wasn't already, in one step
+func (l *revocationList) revokeIfUnused(id string, expiresAt time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.entries[id]; ok {
+		return false
+	}
+
+	now := time.Now()
+	for key, expiry := range l.entries {
+		if now.After(expiry) {
+			delete(l.entries, key)
+		}
+	}
+
+	l.entries[id] = expiresAt
+
+	return true
+}
+
+func (l *revocationList) contains(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.entries[id]
+	return ok
+}
+
+func randomId(bytes int) string {
+	b := make([]byte, bytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
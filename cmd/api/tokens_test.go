@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestIssuer() *tokenIssuer {
+	return &tokenIssuer{
+		issuer:     "broker-test",
+		keys:       map[string][]byte{"k1": []byte("secret-one"), "k2": []byte("secret-two")},
+		activeKey:  "k1",
+		accessTTL:  time.Minute,
+		refreshTTL: time.Hour,
+		revoked:    newRevocationList(),
+	}
+}
+
+func TestTokenParse(t *testing.T) {
+	issuer := newTestIssuer()
+
+	pair, err := issuer.issuePair("ann@example.com", []string{"user"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := issuer.sign("ann@example.com", nil, nil, accessTokenType, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestIssuer()
+	other.keys = map[string][]byte{"k1": []byte("someone-elses-secret")}
+	forged, err := other.sign("ann@example.com", []string{"admin"}, nil, accessTokenType, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestIssuer()
+	rotated.activeKey = "k2"
+	signedWithK2, err := rotated.sign("ann@example.com", nil, nil, accessTokenType, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		raw       string
+		tokenType string
+		wantErr   bool
+	}{
+		{"access token", pair.AccessToken, accessTokenType, false},
+		{"refresh token", pair.RefreshToken, refreshTokenType, false},
+		{"refresh used as access", pair.RefreshToken, accessTokenType, true},
+		{"access used as refresh", pair.AccessToken, refreshTokenType, true},
+		{"expired", expired, accessTokenType, true},
+		{"wrong secret", forged, accessTokenType, true},
+		{"older key still verifies", signedWithK2, accessTokenType, false},
+		{"garbage", "not.a.token", accessTokenType, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := issuer.parse(tt.raw, tt.tokenType)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parse() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	issuer := newTestIssuer()
+
+	pair, err := issuer.issuePair("ann@example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := issuer.parse(pair.RefreshToken, refreshTokenType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !issuer.use(claims) {
+		t.Fatal("first use of a refresh token was refused")
+	}
+	if issuer.use(claims) {
+		t.Fatal("second use of a refresh token was allowed")
+	}
+	if _, err := issuer.parse(pair.RefreshToken, refreshTokenType); err == nil {
+		t.Fatal("parse accepted a revoked token")
+	}
+}
+
+func refreshRequest(t *testing.T, app *Config, refreshToken string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, _ := json.Marshal(refreshPayload{RefreshToken: refreshToken})
+	rr := httptest.NewRecorder()
+	app.RefreshToken(rr, httptest.NewRequest("POST", "/auth/refresh", bytes.NewReader(body)))
+
+	return rr
+}
+
+func TestRefreshTokenIsSingleUse(t *testing.T) {
+	app := &Config{tokens: newTestIssuer()}
+
+	pair, err := app.tokens.issuePair("ann@example.com", []string{"user"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := refreshRequest(t, app, pair.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	var response struct {
+		Data tokenPair `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := app.tokens.parse(response.Data.AccessToken, accessTokenType)
+	if err != nil {
+		t.Fatalf("new access token doesn't parse: %v", err)
+	}
+	if claims.Subject != "ann@example.com" || !contains(claims.Roles, "user") {
+		t.Errorf("new access token lost its subject or roles: %+v", claims)
+	}
+
+	if rr := refreshRequest(t, app, pair.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("reusing a refresh token: status %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestConcurrentRefreshMintsOnePair(t *testing.T) {
+	app := &Config{tokens: newTestIssuer()}
+
+	pair, err := app.tokens.issuePair("ann@example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const attempts = 20
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- refreshRequest(t, app, pair.RefreshToken).Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+
+	if succeeded != 1 {
+		t.Fatalf("%d concurrent refreshes succeeded, want exactly 1", succeeded)
+	}
+}
+
+func TestTokenIssuerNeedsKeysOutsideDevelopment(t *testing.T) {
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	t.Setenv("JWT_EPHEMERAL_KEY", "")
+
+	t.Setenv("BROKER_ENV", "production")
+	if _, err := newTokenIssuerFromEnv(); err == nil {
+		t.Error("started without signing keys in production")
+	}
+
+	t.Setenv("BROKER_ENV", "development")
+	if _, err := newTokenIssuerFromEnv(); err != nil {
+		t.Errorf("development should fall back to a random key: %v", err)
+	}
+
+	t.Setenv("BROKER_ENV", "")
+	t.Setenv("JWT_SIGNING_KEYS", "a:one,b:two")
+	t.Setenv("JWT_ACTIVE_KEY", "b")
+	issuer, err := newTokenIssuerFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuer.activeKey != "b" || len(issuer.keys) != 2 {
+		t.Errorf("keys = %v, active %q, want both keys with b active", issuer.keys, issuer.activeKey)
+	}
+}
+
+func TestLogoutRevokesBothTokens(t *testing.T) {
+	app := &Config{tokens: newTestIssuer()}
+
+	pair, err := app.tokens.issuePair("ann@example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(refreshPayload{RefreshToken: pair.RefreshToken})
+	r := httptest.NewRequest("POST", "/auth/logout", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+	rr := httptest.NewRecorder()
+	app.Logout(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("logout: status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if _, err := app.tokens.parse(pair.AccessToken, accessTokenType); err == nil {
+		t.Error("access token still valid after logout")
+	}
+	if rr := refreshRequest(t, app, pair.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRecheckNoticesRevocationAndExpiry(t *testing.T) {
+	app := &Config{tokens: newTestIssuer()}
+
+	pair, err := app.tokens.issuePair("ann@example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+
+	p, err := app.credentials(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.recheck(p); err != nil {
+		t.Fatalf("fresh token failed the recheck: %v", err)
+	}
+
+	claims, _ := app.tokens.parse(pair.AccessToken, accessTokenType)
+	app.tokens.revoke(claims)
+	if err := app.recheck(p); err == nil {
+		t.Error("recheck passed a revoked token")
+	}
+
+	past := time.Now().Add(-time.Second)
+	if err := app.recheck(&principal{expiresAt: &past}); err == nil {
+		t.Error("recheck passed expired credentials")
+	}
+}
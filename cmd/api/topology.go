@@ -0,0 +1,61 @@
+package main
+
+import (
+	"broker/event"
+	"net/http"
+)
+
+// GetTopology reports the topology and how RabbitMQ differs from it, without changing anything
+func (app *Config) GetTopology(w http.ResponseWriter, r *http.Request) {
+	topology := event.CurrentTopology()
+
+	conn := app.rabbit.Current()
+	if conn == nil {
+		app.errorJson(w, errRabbitUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	drifts, err := topology.Check(conn)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadGateway)
+		return
+	}
+
+	app.writeTopology(w, topology, drifts)
+}
+
+// ApplyTopology declares whatever is missing from the topology, such as a queue deleted by hand since
+// startup, and reports what still differs. Existing exchanges and queues are never changed.
+func (app *Config) ApplyTopology(w http.ResponseWriter, r *http.Request) {
+	topology := event.CurrentTopology()
+
+	conn := app.rabbit.Current()
+	if conn == nil {
+		app.errorJson(w, errRabbitUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	drifts, err := topology.Apply(conn)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadGateway)
+		return
+	}
+
+	app.writeTopology(w, topology, drifts)
+}
+
+func (app *Config) writeTopology(w http.ResponseWriter, topology event.Topology, drifts []event.Drift) {
+	if drifts == nil {
+		drifts = []event.Drift{}
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "topology"
+	payloadResponse.Data = map[string]any{
+		"topology": topology,
+		"drift":    drifts,
+	}
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
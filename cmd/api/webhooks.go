@@ -0,0 +1,571 @@
+package main
+
+import (
+	"broker/event"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type webhookSettings struct {
+	// StorePath persists subscriptions, leave empty to keep them in memory. Replicas share the delivery
+	// queue, so with more than one they need to share the store too.
+	StorePath string `json:"store_path"`
+	// Queue is the durable queue replicas share, so each event is delivered once however many there are
+	Queue          string `json:"queue"`
+	Timeout        string `json:"timeout"`
+	MaxAttempts    int    `json:"max_attempts"`
+	InitialBackoff string `json:"initial_backoff"`
+	MaxBackoff     string `json:"max_backoff"`
+	// DisableAfter is how many deliveries in a row may fail, after all their retries, before the webhook is disabled
+	DisableAfter int `json:"disable_after"`
+	// Concurrency caps delivery attempts in progress across all webhooks. Deliveries waiting to retry don't count.
+	Concurrency int `json:"concurrency"`
+	// QueueSize caps deliveries waiting for an attempt or a retry, events beyond it are dropped
+	QueueSize int `json:"queue_size"`
+	// DeliveryLog is how many deliveries are kept per webhook
+	DeliveryLog int `json:"delivery_log"`
+}
+
+type webhook struct {
+	ID                  string     `json:"id"`
+	URL                 string     `json:"url"`
+	Topics              []string   `json:"topics"`
+	Secret              string     `json:"secret,omitempty"`
+	Active              bool       `json:"active"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+type webhookDelivery struct {
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Success     bool      `json:"success"`
+	DurationMs  int64     `json:"duration_ms"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+type createWebhookPayload struct {
+	URL    string   `json:"url"`
+	Topics []string `json:"topics"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// webhookDispatcher delivers logs_topic events to the registered webhooks
+type webhookDispatcher struct {
+	mu         sync.Mutex
+	settings   webhookSettings
+	timeout    time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	hooks      map[string]*webhook
+	deliveries map[string][]webhookDelivery
+	// queue feeds the workers, pending counts deliveries queued or waiting to retry so the queue never fills
+	queue   chan webhookAttempt
+	pending int
+	client  *http.Client
+}
+
+// webhookAttempt is the next attempt of one delivery
+type webhookAttempt struct {
+	hook       webhook
+	msg        event.Message
+	deliveryID string
+	attempt    int
+	backoff    time.Duration
+}
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// internalTopics carry data that stays inside the platform, mail.send has recipient addresses and
+// message bodies. Webhooks only receive them by subscribing to them by name, "#" doesn't include them.
+var internalTopics = []string{"mail"}
+
+// webhookMatches is event.MatchTopic, except that internal topics only match patterns naming them
+func webhookMatches(pattern, topic string) bool {
+	if !event.MatchTopic(pattern, topic) {
+		return false
+	}
+
+	first, _, _ := strings.Cut(topic, ".")
+	if !contains(internalTopics, first) {
+		return true
+	}
+
+	patternFirst, _, _ := strings.Cut(pattern, ".")
+	return patternFirst == first
+}
+
+func newWebhookDispatcher(s webhookSettings) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		settings:   s,
+		hooks:      map[string]*webhook{},
+		deliveries: map[string][]webhookDelivery{},
+	}
+
+	var err error
+	for _, setting := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{s.Timeout, &d.timeout},
+		{s.InitialBackoff, &d.backoff},
+		{s.MaxBackoff, &d.maxBackoff},
+	} {
+		*setting.target, err = time.ParseDuration(setting.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook duration %q: %w", setting.value, err)
+		}
+	}
+
+	if s.Queue == "" {
+		return nil, errors.New("webhook queue is required")
+	}
+
+	if s.MaxAttempts <= 0 || s.DisableAfter <= 0 || s.Concurrency <= 0 || s.QueueSize <= 0 || s.DeliveryLog <= 0 {
+		return nil, errors.New("webhook max_attempts, disable_after, concurrency, queue_size and delivery_log must be positive")
+	}
+
+	d.queue = make(chan webhookAttempt, s.QueueSize)
+	d.client = &http.Client{Timeout: d.timeout}
+
+	if s.StorePath != "" {
+		data, err := os.ReadFile(s.StorePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		if err == nil {
+			var hooks []*webhook
+			err = json.Unmarshal(data, &hooks)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, hook := range hooks {
+				d.hooks[hook.ID] = hook
+			}
+		}
+	}
+
+	for i := 0; i < s.Concurrency; i++ {
+		go d.work()
+	}
+
+	return d, nil
+}
+
+// handle queues deliveries for the webhook consumer. The event is acked once queued, retries are kept in memory.
+func (d *webhookDispatcher) handle(msg event.Message) error {
+	d.mu.Lock()
+	var matched []webhook
+	for _, hook := range d.hooks {
+		if !hook.Active {
+			continue
+		}
+
+		for _, pattern := range hook.Topics {
+			if webhookMatches(pattern, msg.RoutingKey) {
+				matched = append(matched, *hook)
+				break
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	for _, hook := range matched {
+		d.enqueue(webhookAttempt{
+			hook:       hook,
+			msg:        msg,
+			deliveryID: randomId(16),
+			attempt:    1,
+			backoff:    d.backoff,
+		})
+	}
+
+	return nil
+}
+
+// enqueue takes a new delivery if there is room for it, dropping it otherwise
+func (d *webhookDispatcher) enqueue(a webhookAttempt) {
+	d.mu.Lock()
+	if d.pending >= d.settings.QueueSize {
+		d.mu.Unlock()
+		log.Printf("::webhookDispatcher - queue full, dropped %s for webhook %s", a.msg.RoutingKey, a.hook.ID)
+		d.record(a.hook.ID, webhookDelivery{
+			ID:          a.deliveryID,
+			Topic:       a.msg.RoutingKey,
+			Error:       "dropped, delivery queue is full",
+			DeliveredAt: time.Now(),
+		})
+		return
+	}
+	d.pending++
+	d.mu.Unlock()
+
+	d.queue <- a
+}
+
+// work makes one attempt at a time. A failed attempt is queued again after its backoff instead of
+// holding the worker, and counts as a failure for the webhook once it runs out of attempts.
+func (d *webhookDispatcher) work() {
+	for a := range d.queue {
+		if !d.isActive(a.hook.ID) {
+			d.done()
+			continue
+		}
+
+		delivery := d.attempt(a.hook, a.msg, a.deliveryID, a.attempt)
+		d.record(a.hook.ID, delivery)
+
+		if delivery.Success || a.attempt >= d.settings.MaxAttempts {
+			d.finished(a.hook.ID, delivery.Success)
+			d.done()
+			continue
+		}
+
+		retry := a
+		retry.attempt++
+		retry.backoff = a.backoff * 2
+		if retry.backoff > d.maxBackoff {
+			retry.backoff = d.maxBackoff
+		}
+
+		// The retry is still counted in pending, so there is always room for it
+		time.AfterFunc(a.backoff, func() {
+			d.queue <- retry
+		})
+	}
+}
+
+func (d *webhookDispatcher) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending--
+}
+
+// isActive stops retries for webhooks that were removed or disabled in the meantime
+func (d *webhookDispatcher) isActive(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hook, ok := d.hooks[id]
+	return ok && hook.Active
+}
+
+func (d *webhookDispatcher) attempt(hook webhook, msg event.Message, deliveryID string, attempt int) webhookDelivery {
+	delivery := webhookDelivery{
+		ID:          deliveryID,
+		Topic:       msg.RoutingKey,
+		Attempt:     attempt,
+		DeliveredAt: time.Now(),
+	}
+
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(msg.Body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Broker-Event", msg.RoutingKey)
+	request.Header.Set("X-Broker-Delivery", deliveryID)
+	request.Header.Set("X-Broker-Signature", "t="+timestamp+",v1="+signWebhook(hook.Secret, timestamp, msg.Body))
+
+	response, err := d.client.Do(request)
+	delivery.DurationMs = time.Since(delivery.DeliveredAt).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	response.Body.Close()
+
+	delivery.StatusCode = response.StatusCode
+	delivery.Success = response.StatusCode >= 200 && response.StatusCode < 300
+
+	return delivery
+}
+
+// signWebhook is the HMAC-SHA256 of "<timestamp>.<body>", so receivers can reject replays of old deliveries
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *webhookDispatcher) record(id string, delivery webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entries := append(d.deliveries[id], delivery)
+	if len(entries) > d.settings.DeliveryLog {
+		entries = entries[len(entries)-d.settings.DeliveryLog:]
+	}
+	d.deliveries[id] = entries
+}
+
+func (d *webhookDispatcher) finished(id string, success bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hook, ok := d.hooks[id]
+	if !ok {
+		return
+	}
+
+	if success {
+		hook.ConsecutiveFailures = 0
+		return
+	}
+
+	hook.ConsecutiveFailures++
+	if hook.Active && hook.ConsecutiveFailures >= d.settings.DisableAfter {
+		now := time.Now()
+		hook.Active = false
+		hook.DisabledAt = &now
+		log.Printf("::webhookDispatcher - disabled webhook %s after %d failed deliveries", id, hook.ConsecutiveFailures)
+	}
+
+	err := d.saveLocked()
+	if err != nil {
+		log.Println("::webhookDispatcher - unable to save webhooks:", err)
+	}
+}
+
+func (d *webhookDispatcher) saveLocked() error {
+	if d.settings.StorePath == "" {
+		return nil
+	}
+
+	hooks := make([]*webhook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hooks = append(hooks, hook)
+	}
+
+	data, err := json.MarshalIndent(hooks, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(d.settings.StorePath, ".webhooks-", data)
+}
+
+func (d *webhookDispatcher) create(payload createWebhookPayload) (webhook, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hook := &webhook{
+		ID:        randomId(8),
+		URL:       payload.URL,
+		Topics:    payload.Topics,
+		Secret:    payload.Secret,
+		Active:    true,
+		CreatedAt: time.Now(),
+	}
+
+	if hook.Secret == "" {
+		hook.Secret = randomId(32)
+	}
+
+	d.hooks[hook.ID] = hook
+
+	err := d.saveLocked()
+	if err != nil {
+		delete(d.hooks, hook.ID)
+		return webhook{}, err
+	}
+
+	return *hook, nil
+}
+
+func (d *webhookDispatcher) list() []webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hooks := make([]webhook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		h := *hook
+		h.Secret = ""
+		hooks = append(hooks, h)
+	}
+
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+	})
+
+	return hooks
+}
+
+func (d *webhookDispatcher) remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.hooks[id]; !ok {
+		return errWebhookNotFound
+	}
+
+	delete(d.hooks, id)
+	delete(d.deliveries, id)
+
+	return d.saveLocked()
+}
+
+func (d *webhookDispatcher) enable(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hook, ok := d.hooks[id]
+	if !ok {
+		return errWebhookNotFound
+	}
+
+	hook.Active = true
+	hook.ConsecutiveFailures = 0
+	hook.DisabledAt = nil
+
+	return d.saveLocked()
+}
+
+func (d *webhookDispatcher) deliveryLog(id string) ([]webhookDelivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.hooks[id]; !ok {
+		return nil, errWebhookNotFound
+	}
+
+	return append([]webhookDelivery{}, d.deliveries[id]...), nil
+}
+
+// startWebhooks runs the consumer that feeds the dispatcher
+func (app *Config) startWebhooks() {
+	s := app.settings.Webhooks
+
+	app.startConsumer("webhooks", func(consumer *event.Consumer) error {
+		return consumer.ConsumeDurable(context.Background(), s.Queue, []string{"#"}, s.Concurrency, app.webhooks.handle)
+	})
+}
+
+func (app *Config) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var requestPayload createWebhookPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	u, err := url.Parse(requestPayload.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		app.errorJson(w, errors.New("url must be an absolute http or https URL"))
+		return
+	}
+
+	if len(requestPayload.Topics) == 0 {
+		app.errorJson(w, errors.New("at least one topic is required"))
+		return
+	}
+
+	for _, topic := range requestPayload.Topics {
+		if !validTopicPattern(topic) {
+			app.errorJson(w, fmt.Errorf("invalid topic pattern %q", topic))
+			return
+		}
+	}
+
+	hook, err := app.webhooks.create(requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "webhook created"
+	payloadResponse.Data = hook
+
+	app.writeJson(w, http.StatusCreated, payloadResponse)
+}
+
+func (app *Config) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "webhooks"
+	payloadResponse.Data = app.webhooks.list()
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+func (app *Config) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	err := app.webhooks.remove(chi.URLParam(r, "id"))
+	if errors.Is(err, errWebhookNotFound) {
+		app.errorJson(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "webhook deleted"
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+func (app *Config) EnableWebhook(w http.ResponseWriter, r *http.Request) {
+	err := app.webhooks.enable(chi.URLParam(r, "id"))
+	if errors.Is(err, errWebhookNotFound) {
+		app.errorJson(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "webhook enabled"
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
+
+func (app *Config) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := app.webhooks.deliveryLog(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJson(w, err, http.StatusNotFound)
+		return
+	}
+
+	var payloadResponse jsonResponse
+	payloadResponse.Error = false
+	payloadResponse.Message = "webhook deliveries"
+	payloadResponse.Data = deliveries
+
+	app.writeJson(w, http.StatusOK, payloadResponse)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"broker/event"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testWebhookSettings() webhookSettings {
+	return webhookSettings{
+		Queue:          "webhooks",
+		Timeout:        "1s",
+		MaxAttempts:    3,
+		InitialBackoff: "10ms",
+		MaxBackoff:     "20ms",
+		DisableAfter:   2,
+		Concurrency:    2,
+		QueueSize:      10,
+		DeliveryLog:    10,
+	}
+}
+
+func TestWebhookRetriesThenSucceeds(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	d, err := newWebhookDispatcher(testWebhookSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook, err := d.create(createWebhookPayload{URL: server.URL, Topics: []string{"log.#"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.handle(event.Message{Event: event.Event{RoutingKey: "log.INFO", Body: []byte(`{}`)}})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		deliveries, _ := d.deliveryLog(hook.ID)
+		if len(deliveries) == 2 {
+			if deliveries[0].Success || !deliveries[1].Success || deliveries[1].Attempt != 2 {
+				t.Fatalf("deliveries = %+v, want a failure then a successful second attempt", deliveries)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d deliveries, want 2", len(deliveries))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookQueueIsBounded(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	s := testWebhookSettings()
+	s.Concurrency = 1
+	s.QueueSize = 2
+
+	d, err := newWebhookDispatcher(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook, err := d.create(createWebhookPayload{URL: server.URL, Topics: []string{"#"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		d.handle(event.Message{Event: event.Event{RoutingKey: "log.INFO"}})
+	}
+
+	deliveries, _ := d.deliveryLog(hook.ID)
+	if len(deliveries) != 3 {
+		t.Fatalf("%d deliveries dropped, want 3 of 5 with room for 2", len(deliveries))
+	}
+}
+
+func TestWebhookCreateFailsWhenItCannotBeSaved(t *testing.T) {
+	s := testWebhookSettings()
+	s.StorePath = filepath.Join(t.TempDir(), "missing", "webhooks.json")
+
+	d, err := newWebhookDispatcher(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.create(createWebhookPayload{URL: "http://example.com", Topics: []string{"#"}}); err == nil {
+		t.Fatal("create succeeded without saving")
+	}
+
+	if hooks := d.list(); len(hooks) != 0 {
+		t.Errorf("unsaved webhook was kept: %+v", hooks)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"log.#", "log.INFO", true},
+		{"#", "log.INFO", true},
+		{"log.*", "log.ERROR.db", false},
+		{"#", "mail.send", false},
+		{"*.send", "mail.send", false},
+		{"mail.send", "mail.send", true},
+		{"mail.#", "mail.send", true},
+	}
+
+	for _, tt := range tests {
+		if got := webhookMatches(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("webhookMatches(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookDispatcherNeedsAQueue(t *testing.T) {
+	s := testWebhookSettings()
+	s.Queue = ""
+
+	if _, err := newWebhookDispatcher(s); err == nil {
+		t.Error("newWebhookDispatcher() should need the shared queue name")
+	}
+}
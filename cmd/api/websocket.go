@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type websocketSettings struct {
+	// RateLimit applies to every frame a connection sends, on top of the usual action limits
+	RateLimit   rateLimitRule `json:"rate_limit"`
+	MaxInFlight int           `json:"max_in_flight"`
+	PingPeriod  string        `json:"ping_period"`
+	MaxFrame    int64         `json:"max_frame"`
+}
+
+// validate checks the settings and returns the parsed ping period
+func (s websocketSettings) validate() (time.Duration, error) {
+	pingPeriod, err := time.ParseDuration(s.PingPeriod)
+	if err != nil || pingPeriod <= 0 {
+		return 0, fmt.Errorf("invalid websocket ping_period %q", s.PingPeriod)
+	}
+
+	if _, _, err := s.RateLimit.bucket(); err != nil {
+		return 0, fmt.Errorf("websocket rate_limit: %w", err)
+	}
+
+	if s.MaxInFlight <= 0 || s.MaxFrame <= 0 {
+		return 0, errors.New("websocket max_in_flight and max_frame must be positive")
+	}
+
+	return pingPeriod, nil
+}
+
+// wsFrame is what clients send. Action frames are a RequestPayload envelope plus an id,
+// e.g. {"id": "1", "action": "log", "log": {...}}.
+type wsFrame struct {
+	ID     string   `json:"id"`
+	Type   string   `json:"type"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+type wsResult struct {
+	ID       string        `json:"id,omitempty"`
+	Type     string        `json:"type"`
+	Status   int           `json:"status"`
+	Response *jsonResponse `json:"response"`
+}
+
+type wsEvent struct {
+	Type    string          `json:"type"`
+	EventID uint64          `json:"event_id"`
+	Topic   string          `json:"topic"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// wsConnection serialises writes, gorilla/websocket only allows one writer at a time
+type wsConnection struct {
+	app       *Config
+	conn      *websocket.Conn
+	request   *http.Request
+	principal *principal
+	id        string
+	out       chan any
+	inFlight  chan struct{}
+	sub       *streamSubscriber
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// WebSocket accepts the same envelopes as /handle over a persistent connection,
+// answering each with a result frame carrying the client's id, and pushes events for subscribed topics.
+func (app *Config) WebSocket(w http.ResponseWriter, r *http.Request) {
+	if principalFrom(r.Context()) == nil {
+		app.errorJson(w, unauthenticated(r), http.StatusUnauthorized)
+		return
+	}
+
+	// The cors middleware has already decided whether this origin is allowed
+	origin := r.Header.Get("Origin")
+	originAllowed := origin == "" || w.Header().Get("Access-Control-Allow-Origin") != ""
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return originAllowed
+		},
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written the error response
+		log.Println("::WebSocket - upgrade failed:", err)
+		return
+	}
+
+	c := &wsConnection{
+		app:       app,
+		conn:      conn,
+		request:   r,
+		principal: principalFrom(r.Context()),
+		id:        randomId(8),
+		out:       make(chan any, app.settings.WebSocket.MaxInFlight*2),
+		inFlight:  make(chan struct{}, app.settings.WebSocket.MaxInFlight),
+		done:      make(chan struct{}),
+	}
+
+	c.sub, _ = app.hub.subscribe(nil, app.topicAccess(principalFrom(r.Context())), 0)
+
+	go c.writePump()
+	c.readPump()
+}
+
+// closeWith tells the client why the connection is ending, then closes it
+func (c *wsConnection) closeWith(code int, reason string) {
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.close()
+}
+
+func (c *wsConnection) close() {
+	c.closeOnce.Do(func() {
+		c.app.hub.unsubscribe(c.sub)
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *wsConnection) readPump() {
+	defer c.close()
+
+	pingPeriod := c.app.websocketPingPeriod
+	pongWait := pingPeriod * 2
+
+	c.conn.SetReadLimit(c.app.settings.WebSocket.MaxFrame)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	capacity, refill, _ := c.app.settings.WebSocket.RateLimit.bucket()
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("::WebSocket - read failed:", err)
+			}
+			return
+		}
+
+		var frame wsFrame
+		err = json.Unmarshal(data, &frame)
+		if err != nil {
+			c.sendError(frame.ID, err, http.StatusBadRequest)
+			continue
+		}
+
+		// Revoking a key or token has to end connections made with it, not just new requests
+		err = c.app.recheck(c.principal)
+		if err != nil {
+			c.closeWith(websocket.ClosePolicyViolation, err.Error())
+			return
+		}
+
+		limit, err := c.app.limiter.store.take(context.Background(), "ws:"+c.id, capacity, refill)
+		if err == nil && !limit.Allowed {
+			c.sendError(frame.ID, errors.New("rate limit exceeded"), http.StatusTooManyRequests)
+			continue
+		}
+
+		// Messages also count against the caller's own limit, the same as requests over HTTP
+		if !c.app.takeClient(c.request) {
+			c.sendError(frame.ID, errors.New("rate limit exceeded"), http.StatusTooManyRequests)
+			continue
+		}
+
+		switch frame.Type {
+		case "", "action":
+			c.runAction(frame.ID, data)
+		case "subscribe", "unsubscribe":
+			c.updateTopics(frame)
+		default:
+			c.sendError(frame.ID, fmt.Errorf("unknown frame type %q", frame.Type), http.StatusBadRequest)
+		}
+	}
+}
+
+func (c *wsConnection) runAction(id string, data []byte) {
+	var requestPayload RequestPayload
+
+	err := json.Unmarshal(data, &requestPayload)
+	if err != nil {
+		c.sendError(id, err, http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case c.inFlight <- struct{}{}:
+	default:
+		c.sendError(id, errors.New("too many actions in flight"), http.StatusTooManyRequests)
+		return
+	}
+
+	go func() {
+		defer func() { <-c.inFlight }()
+
+		status, response := c.app.runActionRecorded(c.request, requestPayload)
+
+		c.send(wsResult{ID: id, Type: "result", Status: status, Response: &response})
+	}()
+}
+
+func (c *wsConnection) updateTopics(frame wsFrame) {
+	for _, topic := range frame.Topics {
+		if !validTopicPattern(topic) {
+			c.sendError(frame.ID, fmt.Errorf("invalid topic pattern %q", topic), http.StatusBadRequest)
+			return
+		}
+
+		if frame.Type == "subscribe" && !topicReachable(topic, c.sub.allowed) {
+			c.sendError(frame.ID, fmt.Errorf("not allowed to subscribe to %q", topic), http.StatusForbidden)
+			return
+		}
+	}
+
+	patterns := c.app.hub.updatePatterns(c.sub, frame.Topics, frame.Type == "subscribe")
+
+	c.send(wsResult{
+		ID:     frame.ID,
+		Type:   "result",
+		Status: http.StatusOK,
+		Response: &jsonResponse{
+			Message: frame.Type + "d",
+			Data:    map[string][]string{"topics": patterns},
+		},
+	})
+}
+
+func (c *wsConnection) sendError(id string, err error, status int) {
+	c.send(wsResult{
+		ID:       id,
+		Type:     "result",
+		Status:   status,
+		Response: &jsonResponse{Error: true, Message: err.Error()},
+	})
+}
+
+func (c *wsConnection) send(frame any) {
+	select {
+	case c.out <- frame:
+	case <-c.done:
+	}
+}
+
+func (c *wsConnection) writePump() {
+	ticker := time.NewTicker(c.app.websocketPingPeriod)
+	defer ticker.Stop()
+	defer c.close()
+
+	const writeWait = 10 * time.Second
+
+	// Close the connection when the credentials it was opened with expire
+	var expired <-chan time.Time
+	if c.principal.expiresAt != nil {
+		timer := time.NewTimer(time.Until(*c.principal.expiresAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		var frame any
+
+		select {
+		case <-c.done:
+			return
+		case <-c.sub.slow:
+			_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"), time.Now().Add(writeWait))
+			return
+		case <-expired:
+			c.closeWith(websocket.ClosePolicyViolation, "credentials have expired")
+			return
+		case <-ticker.C:
+			// Connections that only listen still notice a revoked key or token
+			if err := c.app.recheck(c.principal); err != nil {
+				c.closeWith(websocket.ClosePolicyViolation, err.Error())
+				return
+			}
+
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			if err != nil {
+				return
+			}
+			continue
+		case e := <-c.sub.events:
+			frame = wsEvent{Type: "event", EventID: e.ID, Topic: e.Topic, Data: eventData(e.Data)}
+		case frame = <-c.out:
+		}
+
+		_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		err := c.conn.WriteJSON(frame)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// eventData passes JSON bodies through as they are and wraps anything else as a string
+func eventData(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func runAuth(g *globals, args []string) error {
+	fs := flag.NewFlagSet("auth", flag.ContinueOnError)
+	email := fs.String("email", "", "user email")
+	password := fs.String("password", "", "user password")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *email == "" || *password == "" {
+		return errors.New("-email and -password are required")
+	}
+
+	return g.submit("/handle", "auth", map[string]string{
+		"email":    *email,
+		"password": *password,
+	})
+}
+
+func runLog(g *globals, args []string) error {
+	fs := flag.NewFlagSet("log", flag.ContinueOnError)
+	name := fs.String("name", "", "log entry name")
+	data := fs.String("data", "", "log entry data")
+	severity := fs.String("severity", "", "DEBUG, INFO, WARN, ERROR or FATAL")
+	category := fs.String("category", "", "optional category, a single word")
+	viaGrpc := fs.Bool("grpc", false, "log through /log-grpc")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+
+	path := "/handle"
+	if *viaGrpc {
+		path = "/log-grpc"
+	}
+
+	return g.submit(path, "log", map[string]string{
+		"name":     *name,
+		"data":     *data,
+		"severity": *severity,
+		"category": *category,
+	})
+}
+
+func runMail(g *globals, args []string) error {
+	fs := flag.NewFlagSet("mail", flag.ContinueOnError)
+	from := fs.String("from", "", "sender address")
+	to := fs.String("to", "", "recipient address")
+	subject := fs.String("subject", "", "subject line")
+	message := fs.String("message", "", "message body")
+	mode := fs.String("mode", "", `"sync" or "queued", defaults to the broker's setting`)
+	sendAt := fs.String("send-at", "", "RFC 3339 time to send the mail at")
+	delay := fs.String("delay", "", "how long to wait before sending, e.g. 30m")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *to == "" || *subject == "" {
+		return errors.New("-to and -subject are required")
+	}
+
+	payload := map[string]any{
+		"from":    *from,
+		"to":      *to,
+		"subject": *subject,
+		"message": *message,
+	}
+
+	if *mode != "" {
+		payload["mode"] = *mode
+	}
+
+	if *sendAt != "" {
+		at, err := time.Parse(time.RFC3339, *sendAt)
+		if err != nil {
+			return fmt.Errorf("-send-at: %w", err)
+		}
+		payload["send_at"] = at
+	}
+
+	if *delay != "" {
+		payload["delay"] = *delay
+	}
+
+	return g.submit("/handle", "mail", payload)
+}
+
+type healthResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status      string         `json:"status"`
+	Critical    []healthResult `json:"critical"`
+	NonCritical []healthResult `json:"non_critical"`
+}
+
+func runHealth(g *globals, args []string) error {
+	fs := flag.NewFlagSet("health", flag.ContinueOnError)
+	live := fs.Bool("live", false, "only run the liveness checks")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	path := "/healthz/ready"
+	if *live {
+		path = "/healthz/live"
+	}
+
+	status, response, err := g.call("GET", path, nil)
+	if err != nil {
+		return err
+	}
+
+	if g.json {
+		g.printJSON(response)
+	} else {
+		var report healthReport
+		_ = decodeData(response, &report)
+
+		fmt.Fprintf(g.out, "broker: %s\n", response.Message)
+		for _, group := range []struct {
+			label   string
+			results []healthResult
+		}{
+			{"critical", report.Critical},
+			{"non-critical", report.NonCritical},
+		} {
+			for _, r := range group.results {
+				fmt.Fprintf(g.out, "  %-20s %-12s %-5s %4dms %s\n", r.Name, group.label, r.Status, r.LatencyMs, r.Error)
+			}
+		}
+	}
+
+	if status != http.StatusOK {
+		return fmt.Errorf("broker is %s", response.Message)
+	}
+
+	return nil
+}
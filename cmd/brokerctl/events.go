@@ -0,0 +1,189 @@
+package main
+
+import (
+	"broker/event"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func dial(g *globals) (*amqp.Connection, error) {
+	conn, err := amqp.Dial(g.amqp)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to RabbitMQ: %w", err)
+	}
+
+	return conn, nil
+}
+
+func runPublish(g *globals, args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	topic := fs.String("topic", "", "routing key, e.g. log.INFO")
+	eventType := fs.String("type", "", "event type, defaults to the topic")
+	subject := fs.String("subject", "", "event subject")
+	format := fs.String("format", "plain", "plain, cloudevents-binary or cloudevents-structured")
+	file := fs.String("file", "", `read the body from a file, "-" for stdin`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: brokerctl publish -topic <key> [flags] [body]\n")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *topic == "" {
+		return errors.New("-topic is required")
+	}
+
+	eventFormat, err := event.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	switch {
+	case *file == "-":
+		body, err = io.ReadAll(os.Stdin)
+	case *file != "":
+		body, err = os.ReadFile(*file)
+	case fs.NArg() == 1:
+		body = []byte(fs.Arg(0))
+	default:
+		return errors.New("give the body as one argument or with -file")
+	}
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial(g)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	emitter, err := event.NewEmitter(conn)
+	if err != nil {
+		return err
+	}
+
+	e := event.Event{
+		ID:         fmt.Sprintf("brokerctl-%d", time.Now().UnixNano()),
+		RoutingKey: *topic,
+		Type:       *eventType,
+		Subject:    *subject,
+		AppID:      "brokerctl",
+		Format:     eventFormat,
+		Body:       body,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = emitter.Publish(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	if g.json {
+		g.printJSON(map[string]string{"id": e.ID, "topic": e.RoutingKey})
+	} else {
+		fmt.Fprintf(g.out, "published %s to %s\n", e.ID, e.RoutingKey)
+	}
+
+	return nil
+}
+
+// tailEvent is how tail prints a message with -json
+type tailEvent struct {
+	ID          string         `json:"id"`
+	Topic       string         `json:"topic"`
+	Type        string         `json:"type,omitempty"`
+	Subject     string         `json:"subject,omitempty"`
+	Source      string         `json:"source,omitempty"`
+	Format      event.Format   `json:"format"`
+	Time        time.Time      `json:"time"`
+	ContentType string         `json:"content_type,omitempty"`
+	Headers     map[string]any `json:"headers,omitempty"`
+	Body        string         `json:"body"`
+}
+
+func runTail(g *globals, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	count := fs.Int("n", 0, "stop after this many events, 0 to keep going")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: brokerctl tail [flags] [pattern ...]\n\nPatterns use AMQP topic syntax and default to #.\n")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	patterns := fs.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"#"}
+	}
+
+	conn, err := dial(g)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	consumer, err := event.NewConsumer(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	seen := 0
+	err = consumer.Consume(ctx, patterns, func(msg event.Message) {
+		g.printEvent(msg)
+
+		seen++
+		if *count > 0 && seen >= *count {
+			cancel()
+		}
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+
+	return err
+}
+
+func (g *globals) printEvent(msg event.Message) {
+	if g.json {
+		g.printJSON(tailEvent{
+			ID:          msg.ID,
+			Topic:       msg.RoutingKey,
+			Type:        msg.Type,
+			Subject:     msg.Subject,
+			Source:      msg.AppID,
+			Format:      msg.Format,
+			Time:        msg.Timestamp,
+			ContentType: msg.ContentType,
+			Headers:     msg.Headers,
+			Body:        string(msg.Body),
+		})
+		return
+	}
+
+	fmt.Fprintf(g.out, "%s %-20s %s %s\n", msg.Timestamp.Local().Format("15:04:05.000"), msg.RoutingKey, msg.ID, msg.Body)
+}
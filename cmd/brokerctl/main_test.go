@@ -0,0 +1,168 @@
+package main
+
+import (
+	"broker/event"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBroker records the last request and answers every path with the status and reply registered for it
+func fakeBroker(t *testing.T, replies map[string]int) (*httptest.Server, *http.Request, *[]byte) {
+	t.Helper()
+
+	var last http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = *r
+		body, _ = io.ReadAll(r.Body)
+
+		status, ok := replies[r.URL.Path]
+		if !ok {
+			status = http.StatusNotFound
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error":   status >= 400,
+			"message": http.StatusText(status),
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &last, &body
+}
+
+func TestRun(t *testing.T) {
+	server, last, body := fakeBroker(t, map[string]int{
+		"/handle":        http.StatusAccepted,
+		"/log-grpc":      http.StatusAccepted,
+		"/healthz/ready": http.StatusServiceUnavailable,
+		"/healthz/live":  http.StatusOK,
+	})
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantErr  string
+		wantPath string
+		wantBody string
+		wantOut  string
+	}{
+		{
+			name:     "log",
+			args:     []string{"log", "-name", "event", "-data", "d", "-severity", "WARN"},
+			wantPath: "/handle",
+			wantBody: `"action":"log"`,
+			wantOut:  "202 Accepted",
+		},
+		{
+			name:     "log over grpc",
+			args:     []string{"log", "-grpc", "-name", "event"},
+			wantPath: "/log-grpc",
+			wantBody: `"name":"event"`,
+		},
+		{
+			name:     "mail",
+			args:     []string{"mail", "-to", "you@example.com", "-subject", "hi", "-delay", "30m"},
+			wantPath: "/handle",
+			wantBody: `"delay":"30m"`,
+		},
+		{name: "missing flags", args: []string{"log"}, wantErr: "-name is required"},
+		{name: "healthy", args: []string{"health", "-live"}, wantPath: "/healthz/live", wantOut: "broker: OK"},
+		{name: "unhealthy", args: []string{"health"}, wantPath: "/healthz/ready", wantErr: "broker is Service Unavailable"},
+		{name: "no command", args: nil, wantErr: "a command is required"},
+		{name: "unknown command", args: []string{"frobnicate"}, wantErr: `unknown command "frobnicate"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*last = http.Request{}
+			*body = nil
+
+			var out bytes.Buffer
+			args := append([]string{"-broker", server.URL + "/", "-token", "secret"}, tt.args...)
+
+			err := run(args, &out)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("run() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("run() = %v, want an error containing %q", err, tt.wantErr)
+			}
+
+			if tt.wantPath != "" {
+				if last.URL == nil || last.URL.Path != tt.wantPath {
+					t.Fatalf("request went to %v, want %s", last.URL, tt.wantPath)
+				}
+				if got := last.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("Authorization = %q, want the bearer token", got)
+				}
+			}
+
+			if !strings.Contains(string(*body), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", *body, tt.wantBody)
+			}
+
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("output = %q, want it to contain %q", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestRunPrintsJSON(t *testing.T) {
+	server, _, _ := fakeBroker(t, map[string]int{"/handle": http.StatusOK})
+
+	var out bytes.Buffer
+	err := run([]string{"-broker", server.URL, "-json", "auth", "-email", "a@example.com", "-password", "p"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response jsonResponse
+	if err := json.Unmarshal(out.Bytes(), &response); err != nil || response.Message != "OK" {
+		t.Errorf("output = %q, want the reply as JSON", out.String())
+	}
+}
+
+func TestTailPrintsAJSONStream(t *testing.T) {
+	var out bytes.Buffer
+	g := &globals{json: true, out: &out}
+
+	sent := []event.Message{
+		{Event: event.Event{ID: "e1", RoutingKey: "log.INFO", Type: event.LogEventType, Timestamp: time.Now(), Body: []byte(`{"name":"a"}`)}},
+		{Event: event.Event{ID: "e2", RoutingKey: "log.ERROR.billing", Format: event.FormatCloudEventsBinary, Body: []byte("line one\nline two")}},
+		{Event: event.Event{ID: "e3", RoutingKey: "mail.send", Headers: map[string]any{"tenant": "acme"}}},
+	}
+	for _, msg := range sent {
+		g.printEvent(msg)
+	}
+
+	// Whatever reads -json output decodes one value after another until EOF
+	decoder := json.NewDecoder(&out)
+	for i := 0; ; i++ {
+		var got tailEvent
+		err := decoder.Decode(&got)
+		if err == io.EOF {
+			if i != len(sent) {
+				t.Errorf("decoded %d events, want %d", i, len(sent))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+
+		if i >= len(sent) || got.ID != sent[i].ID || got.Topic != sent[i].RoutingKey || got.Body != string(sent[i].Body) {
+			t.Errorf("event %d = %+v, want %s on %s", i, got, sent[i].ID, sent[i].RoutingKey)
+		}
+	}
+}
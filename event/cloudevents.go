@@ -0,0 +1,169 @@
+package event
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Format is how an Event is laid out on the wire. Consumers read all of them, so the
+// format can be switched without a coordinated release.
+type Format string
+
+const (
+	// FormatPlain sends the body as it is with the details in AMQP properties
+	FormatPlain Format = "plain"
+	// FormatCloudEventsBinary is the CloudEvents 1.0 AMQP binding's binary mode, attributes go in headers
+	FormatCloudEventsBinary Format = "cloudevents-binary"
+	// FormatCloudEventsStructured wraps the body in a CloudEvents 1.0 JSON envelope
+	FormatCloudEventsStructured Format = "cloudevents-structured"
+)
+
+const (
+	cloudEventsVersion     = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsPrefix      = "cloudEvents:"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatPlain, FormatCloudEventsBinary, FormatCloudEventsStructured:
+		return f, nil
+	case "":
+		return FormatPlain, nil
+	default:
+		return "", fmt.Errorf("unknown event format %q", s)
+	}
+}
+
+// cloudEvent is the structured mode envelope
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            *time.Time      `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// toCloudEventsBinary moves the event's attributes into cloudEvents: headers
+func toCloudEventsBinary(e Event, p amqp.Publishing) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+
+	headers[cloudEventsPrefix+"specversion"] = cloudEventsVersion
+	headers[cloudEventsPrefix+"id"] = e.ID
+	headers[cloudEventsPrefix+"source"] = e.AppID
+	headers[cloudEventsPrefix+"type"] = e.Type
+	headers[cloudEventsPrefix+"time"] = e.Timestamp.Format(time.RFC3339Nano)
+	if e.Subject != "" {
+		headers[cloudEventsPrefix+"subject"] = e.Subject
+	}
+
+	p.Headers = headers
+
+	return p
+}
+
+// toCloudEventsStructured replaces the body with a JSON envelope carrying it as data
+func toCloudEventsStructured(e Event, p amqp.Publishing) amqp.Publishing {
+	ts := e.Timestamp
+	ce := cloudEvent{
+		SpecVersion:     cloudEventsVersion,
+		ID:              e.ID,
+		Source:          e.AppID,
+		Type:            e.Type,
+		Subject:         e.Subject,
+		Time:            &ts,
+		DataContentType: e.ContentType,
+	}
+
+	switch {
+	case isJSONContentType(e.ContentType) && json.Valid(e.Body):
+		ce.Data = e.Body
+	case strings.HasPrefix(e.ContentType, "text/"):
+		ce.Data, _ = json.Marshal(string(e.Body))
+	default:
+		ce.DataBase64 = base64.StdEncoding.EncodeToString(e.Body)
+	}
+
+	p.Body, _ = json.Marshal(ce)
+	p.ContentType = cloudEventsContentType
+
+	return p
+}
+
+// fromCloudEvents recognises either CloudEvents mode and reads its attributes over e.
+// Anything else is left alone as a plain event.
+func fromCloudEvents(e Event) Event {
+	mediaType, _, _ := strings.Cut(e.ContentType, ";")
+	if strings.TrimSpace(mediaType) == cloudEventsContentType {
+		var ce cloudEvent
+		if json.Unmarshal(e.Body, &ce) != nil {
+			return e
+		}
+
+		e.Format = FormatCloudEventsStructured
+		e.ID = ce.ID
+		e.AppID = ce.Source
+		e.Type = ce.Type
+		e.Subject = ce.Subject
+		e.ContentType = ce.DataContentType
+		if ce.Time != nil {
+			e.Timestamp = *ce.Time
+		}
+
+		switch {
+		case ce.DataBase64 != "":
+			e.Body, _ = base64.StdEncoding.DecodeString(ce.DataBase64)
+		case isJSONContentType(ce.DataContentType) || ce.DataContentType == "":
+			e.Body = ce.Data
+		default:
+			var text string
+			if json.Unmarshal(ce.Data, &text) == nil {
+				e.Body = []byte(text)
+			} else {
+				e.Body = ce.Data
+			}
+		}
+
+		return e
+	}
+
+	if _, ok := e.Headers[cloudEventsPrefix+"specversion"]; !ok {
+		e.Format = FormatPlain
+		return e
+	}
+
+	e.Format = FormatCloudEventsBinary
+	header := func(name string) string {
+		s, _ := e.Headers[cloudEventsPrefix+name].(string)
+		return s
+	}
+
+	e.ID = header("id")
+	e.AppID = header("source")
+	e.Type = header("type")
+	e.Subject = header("subject")
+	if ts, err := time.Parse(time.RFC3339Nano, header("time")); err == nil {
+		e.Timestamp = ts
+	}
+
+	return e
+}
@@ -0,0 +1,138 @@
+package event
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Format
+		wantErr bool
+	}{
+		{"", FormatPlain, false},
+		{"plain", FormatPlain, false},
+		{"cloudevents-binary", FormatCloudEventsBinary, false},
+		{"cloudevents-structured", FormatCloudEventsStructured, false},
+		{"xml", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseFormat(tt.in)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ParseFormat(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCloudEventsRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		format      Format
+		contentType string
+		body        []byte
+	}{
+		{"binary json", FormatCloudEventsBinary, "application/json", []byte(`{"name":"invoice"}`)},
+		{"binary text", FormatCloudEventsBinary, "text/plain", []byte("hello")},
+		{"structured json", FormatCloudEventsStructured, "application/json", []byte(`{"name":"invoice"}`)},
+		{"structured json suffix", FormatCloudEventsStructured, "application/vnd.acme+json; charset=utf-8", []byte(`{"a":1}`)},
+		{"structured text", FormatCloudEventsStructured, "text/plain", []byte("hello \"world\"")},
+		{"structured bytes", FormatCloudEventsStructured, "application/octet-stream", []byte{0, 1, 2, 255}},
+		{"structured invalid json", FormatCloudEventsStructured, "application/json", []byte("{not json")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := Event{
+				ID:          "e1",
+				RoutingKey:  "log.INFO",
+				Type:        LogEventType,
+				Subject:     "invoice",
+				AppID:       "billing-service",
+				ContentType: tt.contentType,
+				Headers:     map[string]any{"tenant": "acme"},
+				Timestamp:   ts,
+				Format:      tt.format,
+				Body:        tt.body,
+			}
+
+			p := sent.publishing()
+			got := eventFromDelivery(deliver(p, sent.RoutingKey))
+
+			if got.Format != tt.format {
+				t.Errorf("format = %q, want %q", got.Format, tt.format)
+			}
+
+			if got.ID != sent.ID || got.Type != sent.Type || got.Subject != sent.Subject || got.AppID != sent.AppID {
+				t.Errorf("attributes = %q %q %q %q, want %q %q %q %q",
+					got.ID, got.Type, got.Subject, got.AppID, sent.ID, sent.Type, sent.Subject, sent.AppID)
+			}
+
+			if !got.Timestamp.Equal(ts) {
+				t.Errorf("timestamp = %s, want %s", got.Timestamp, ts)
+			}
+
+			if got.ContentType != tt.contentType || string(got.Body) != string(tt.body) {
+				t.Errorf("body = %q (%s), want %q (%s)", got.Body, got.ContentType, tt.body, tt.contentType)
+			}
+
+			if got.Headers["tenant"] != "acme" {
+				t.Errorf("headers = %v, want the tenant header kept", got.Headers)
+			}
+		})
+	}
+}
+
+func TestCloudEventsStructuredEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    Event
+		wantData string
+		wantB64  string
+	}{
+		{"json goes in data", Event{ContentType: "application/json", Body: []byte(`{"a":1}`)}, `{"a":1}`, ""},
+		{"text is a json string", Event{ContentType: "text/plain", Body: []byte("hi")}, `"hi"`, ""},
+		{"bytes are base64", Event{ContentType: "image/png", Body: []byte{1, 2}}, "", "AQI="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event.Format = FormatCloudEventsStructured
+			p := tt.event.withDefaults().publishing()
+
+			if p.ContentType != cloudEventsContentType {
+				t.Errorf("content type = %q, want %q", p.ContentType, cloudEventsContentType)
+			}
+
+			var ce cloudEvent
+			if err := json.Unmarshal(p.Body, &ce); err != nil {
+				t.Fatal(err)
+			}
+
+			if ce.SpecVersion != cloudEventsVersion || string(ce.Data) != tt.wantData || ce.DataBase64 != tt.wantB64 {
+				t.Errorf("envelope = %s, want data %s base64 %q", p.Body, tt.wantData, tt.wantB64)
+			}
+		})
+	}
+}
+
+func TestCloudEventsBinaryHeaders(t *testing.T) {
+	e := Event{RoutingKey: "log.INFO", Subject: "invoice", Format: FormatCloudEventsBinary, Body: []byte("hi")}.withDefaults()
+	p := e.publishing()
+
+	for _, name := range []string{"specversion", "id", "source", "type", "time", "subject"} {
+		if _, ok := p.Headers[cloudEventsPrefix+name]; !ok {
+			t.Errorf("header %s%s is missing from %v", cloudEventsPrefix, name, p.Headers)
+		}
+	}
+
+	if string(p.Body) != "hi" || p.ContentType != "text/plain" {
+		t.Errorf("body %q (%s), want it left as it was", p.Body, p.ContentType)
+	}
+}
@@ -0,0 +1,162 @@
+package event
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Connection keeps a service connected to RabbitMQ, redialling in the background whenever the
+// connection is lost, so the service can start and keep serving while RabbitMQ is down
+type Connection struct {
+	url string
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+	// ready is closed once conn is set, and replaced when it is lost
+	ready chan struct{}
+}
+
+func NewConnection(url string) *Connection {
+	return &Connection{
+		url:   url,
+		ready: make(chan struct{}),
+	}
+}
+
+// Current is the open connection, or nil while RabbitMQ can't be reached
+func (c *Connection) Current() *amqp.Connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil
+	}
+
+	return c.conn
+}
+
+// Wait blocks until there is a connection or ctx is done
+func (c *Connection) Wait(ctx context.Context) (*amqp.Connection, error) {
+	c.mu.Lock()
+	conn, ready := c.conn, c.ready
+	c.mu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ready:
+		return c.Wait(ctx)
+	}
+}
+
+// Run dials RabbitMQ and applies the topology to each new connection until ctx is cancelled,
+// backing off while RabbitMQ is down
+func (c *Connection) Run(ctx context.Context) {
+	backOff := time.Second
+
+	for {
+		conn, err := amqp.Dial(c.url)
+		if err == nil {
+			// Drift is logged rather than fatal, the existing queues keep working
+			_, err = ApplyTopology(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+
+		if err != nil {
+			log.Printf("::Connection - RabbitMQ not ready, retrying in %s: %s", backOff, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backOff):
+			}
+
+			backOff *= 2
+			if backOff > 30*time.Second {
+				backOff = 30 * time.Second
+			}
+			continue
+		}
+
+		log.Println("Connected to RabbitMQ!")
+		backOff = time.Second
+
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		c.mu.Lock()
+		c.conn = conn
+		close(c.ready)
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return
+		case err := <-closed:
+			log.Println("::Connection - connection lost:", err)
+		}
+
+		c.mu.Lock()
+		c.conn = nil
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+	}
+}
+
+// RunningConsumer is a consumer that is started again on every new connection
+type RunningConsumer struct {
+	Name string
+
+	mu       sync.Mutex
+	consumer *Consumer
+}
+
+// Alive reports whether the consumer is listening on the current connection
+func (rc *RunningConsumer) Alive() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.consumer != nil && rc.consumer.Alive()
+}
+
+// Keep runs consume on a consumer of the current connection, and again on the next connection
+// whenever it stops, until ctx is cancelled
+func (c *Connection) Keep(ctx context.Context, running *RunningConsumer, consume func(consumer *Consumer) error) error {
+	for {
+		conn, err := c.Wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		consumer, err := NewConsumer(conn)
+		if err == nil {
+			running.mu.Lock()
+			running.consumer = &consumer
+			running.mu.Unlock()
+
+			err = consume(&consumer)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("::Keep - %s consumer stopped, restarting: %s", running.Name, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
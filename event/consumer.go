@@ -2,10 +2,14 @@ package event
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync/atomic"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -13,11 +17,17 @@ import (
 type Consumer struct {
 	conn *amqp.Connection
 	queueName string
+	listening *int32
+	// Schemas upcasts deliveries before handlers see them
+	Schemas *Registry
 }
 
+
 func NewConsumer(conn *amqp.Connection) (Consumer, error) {
 	consumer := Consumer{
 		conn: conn,
+		listening: new(int32),
+		Schemas:   Schemas,
 	}
 
 	err := consumer.setup()
@@ -28,21 +38,81 @@ func NewConsumer(conn *amqp.Connection) (Consumer, error) {
 	return consumer, nil
 }
 
+// setup makes sure the topology has been applied to the connection
 func (consumer *Consumer) setup() error {
-	channel, err := consumer.conn.Channel()
-	if err != nil {
-		return err
+	_, err := ApplyTopology(consumer.conn)
+	return err
+}
+
+type Payload struct {
+	Version  int    `json:"version"`
+	Name     string `json:"name"`
+	Data     string `json:"data"`
+	Severity string `json:"severity"`
+	Category string `json:"category,omitempty"`
+}
+
+// Severities a log payload may have, in increasing order
+var Severities = []string{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// LogRoutingKey is log.<SEVERITY>, followed by .<category> when there is one
+func LogRoutingKey(severity, category string) string {
+	key := "log." + strings.ToUpper(severity)
+	if category != "" {
+		key += "." + category
 	}
 
-	return declareExchange(channel)
+	return key
 }
 
-type Payload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+// Event wraps the payload for publishing as a broker.log event about p.Name,
+// routed by its severity and category
+func (p Payload) Event() Event {
+	p.Version = PayloadVersion
+	if p.Severity == "" {
+		p.Severity = "INFO"
+	}
+	p.Severity = strings.ToUpper(p.Severity)
+
+	body, _ := json.MarshalIndent(&p, "", "\t")
+
+	return Event{
+		RoutingKey: LogRoutingKey(p.Severity, p.Category),
+		Type:       LogEventType,
+		Subject:    p.Name,
+		Body:       body,
+	}
+}
+
+// Message is a delivery from logs_topic as seen by a Handler, carrying the properties it was published with
+type Message struct {
+	Event
+	Redelivered bool
 }
 
+func messageFromDelivery(d amqp.Delivery) Message {
+	return Message{
+		Event:       eventFromDelivery(d),
+		Redelivered: d.Redelivered,
+	}
+}
+
+type Handler func(msg Message)
+
+// Listen logs every payload published on topics, blocking until the connection goes away
 func (consumer *Consumer) Listen(topics []string) error {
+	return consumer.Consume(context.Background(), topics, func(msg Message) {
+		var payload Payload
+		_ = json.Unmarshal(msg.Body, &payload)
+
+		// More concurrenty for speed
+		go handlePayload(payload)
+	})
+}
+
+// Consume binds a fresh queue to topics and hands each delivery to handler, in order,
+// until ctx is cancelled or the channel closes
+func (consumer *Consumer) Consume(ctx context.Context, topics []string, handler Handler) error {
 	ch, err := consumer.conn.Channel()
 	if err != nil {
 		return err
@@ -77,25 +147,136 @@ func (consumer *Consumer) Listen(topics []string) error {
 		false,
 		 nil,
 	)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(consumer.listening, 1)
+	defer atomic.StoreInt32(consumer.listening, 0)
+
+	log.Printf("::Consume - waiting for messages on exchange [Exchange, Queue] [logs_topic, %s]", q.Name)
+
+	// This will block until the channel or connection goes away
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-messages:
+			if !ok {
+				return errors.New("consumer delivery channel closed")
+			}
+
+			msg := messageFromDelivery(d)
+			msg.Event, err = consumer.Schemas.Upcast(msg.Event)
+			if err != nil {
+				// Every temporary queue gets its own copy, so dead-lettering here would file the same
+				// event once per consumer. Durable queues dead-letter it once, see ConsumeDurable.
+				log.Printf("::Consume - dropping %s message %s: %s", d.RoutingKey, d.MessageId, err)
+				continue
+			}
 
-	// Listen forever
-	forever := make(chan bool)
-	go func() {
-		for d := range messages {
-			var payload Payload
-			_ = json.Unmarshal(d.Body, &payload)
-			
-			// More concurrenty for speed
-			go handlePayload(payload)
+			handler(msg)
 		}
-	}()
+	}
+}
 
-	fmt.Printf("Waiting for messages on exchange [Exchange, Queue] [logs_topic, %s]\n", q.Name)
-	
-	// This will cause it to block
-	<-forever
+// ConsumeDurable binds the named durable queue to topics and runs handler on up to concurrency
+// deliveries at once. Deliveries are acked when handler succeeds and dead-lettered when it fails.
+func (consumer *Consumer) ConsumeDurable(ctx context.Context, queueName string, topics []string, concurrency int, handler func(msg Message) error) error {
+	ch, err := consumer.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
 
-	return nil
+	q, err := declareDurableQueue(ch, queueName)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range topics {
+		err = ch.QueueBind(q.Name, s, "logs_topic", false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ch.Qos(concurrency, 0, false)
+	if err != nil {
+		return err
+	}
+
+	messages, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(consumer.listening, 1)
+	defer atomic.StoreInt32(consumer.listening, 0)
+
+	log.Printf("::ConsumeDurable - waiting for messages on exchange [Exchange, Queue] [logs_topic, %s]", q.Name)
+
+	slots := make(chan struct{}, concurrency)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Let the handlers in progress finish and ack before the channel closes
+			for i := 0; i < concurrency; i++ {
+				slots <- struct{}{}
+			}
+			return ctx.Err()
+		case d, ok := <-messages:
+			if !ok {
+				return errors.New("consumer delivery channel closed")
+			}
+
+			slots <- struct{}{}
+			go func(d amqp.Delivery) {
+				defer func() { <-slots }()
+				consumer.handleDurable(queueName, d, handler)
+			}(d)
+		}
+	}
+}
+
+// handleDurable acks d once handler has taken it, or dead-letters it when it can't be upcast or handler fails
+func (consumer *Consumer) handleDurable(queueName string, d amqp.Delivery, handler func(msg Message) error) {
+	msg := messageFromDelivery(d)
+
+	var err error
+	msg.Event, err = consumer.Schemas.Upcast(msg.Event)
+	if err == nil {
+		err = handler(msg)
+	}
+	if err != nil {
+		log.Printf("::ConsumeDurable - dead-lettering message from %s: %s", queueName, err)
+		_ = d.Nack(false, false)
+		return
+	}
+
+	_ = d.Ack(false)
+}
+
+// Alive reports whether Listen or Consume is still receiving deliveries on an open connection
+func (consumer *Consumer) Alive() bool {
+	if consumer.listening == nil || atomic.LoadInt32(consumer.listening) == 0 {
+		return false
+	}
+
+	return !consumer.conn.IsClosed()
+}
+
+// HandleLog sends a broker.log event to logger-service, for use with ConsumeDurable
+func HandleLog(msg Message) error {
+	var payload Payload
+
+	err := json.Unmarshal(msg.Body, &payload)
+	if err != nil {
+		return fmt.Errorf("unreadable log payload: %w", err)
+	}
+
+	return logEvent(payload)
 }
 
 func handlePayload(payload Payload) {
@@ -142,7 +323,7 @@ func logEvent(entry Payload) error {
 	log.Printf("::logEvent - response from logger server, Code %d", response.StatusCode)
 
 	if response.StatusCode != http.StatusAccepted {
-		return err
+		return fmt.Errorf("logger service returned %d", response.StatusCode)
 	}
 
 	return nil
@@ -0,0 +1,78 @@
+package event
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeAcknowledger records how a delivery was settled
+type fakeAcknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestConsumeDurableSettlesDeliveries(t *testing.T) {
+	handlerErr := errors.New("logger-service is down")
+
+	tests := []struct {
+		name        string
+		body        string
+		handlerErr  error
+		wantHandled bool
+		wantAck     bool
+	}{
+		{"handled", `{"version":2,"name":"x","severity":"INFO"}`, nil, true, true},
+		{"upcast then handled", `{"name":"x"}`, nil, true, true},
+		{"handler fails", `{"version":2,"name":"x"}`, handlerErr, true, false},
+		{"newer version", `{"version":9,"name":"x"}`, nil, false, false},
+		{"not json", `oops`, nil, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &fakeAcknowledger{}
+			d := amqp.Delivery{Acknowledger: ack, RoutingKey: "log.INFO", Type: LogEventType, Body: []byte(tt.body)}
+
+			consumer := &Consumer{Schemas: defaultRegistry()}
+
+			var handled *Message
+			consumer.handleDurable("logs", d, func(msg Message) error {
+				handled = &msg
+				return tt.handlerErr
+			})
+
+			if (handled != nil) != tt.wantHandled {
+				t.Errorf("handler called = %v, want %v", handled != nil, tt.wantHandled)
+			}
+
+			if handled != nil && !strings.Contains(string(handled.Body), `"version":2`) {
+				t.Errorf("handler saw %s, want the upcast body", handled.Body)
+			}
+
+			if ack.acked != tt.wantAck || ack.nacked == tt.wantAck {
+				t.Errorf("acked %v nacked %v, want acked %v", ack.acked, ack.nacked, tt.wantAck)
+			}
+
+			// Requeueing would loop the failure, the queue's dead-letter exchange takes it instead
+			if ack.requeued {
+				t.Error("a failed delivery should not be requeued")
+			}
+		})
+	}
+}
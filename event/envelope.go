@@ -0,0 +1,127 @@
+package event
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultAppID is sent as the AMQP app-id when an Event doesn't name its source
+const DefaultAppID = "broker-service"
+
+// Event is a message on logs_topic along with its AMQP properties. Publish fills in
+// anything left empty.
+type Event struct {
+	ID         string
+	RoutingKey string
+	// Type defaults to the routing key
+	Type string
+	// Subject is what the event is about, e.g. the name of a log entry
+	Subject       string
+	AppID         string
+	ContentType   string
+	CorrelationID string
+	Headers       map[string]any
+	Priority      uint8
+	// Expiration discards the message if it sits in a queue for longer, zero keeps it forever
+	Expiration time.Duration
+	Timestamp  time.Time
+	// Transient events are not written to disk by RabbitMQ
+	Transient bool
+	// Format defaults to the Emmitter's, on a received Message it is the format the event arrived in
+	Format Format
+	Body   []byte
+}
+
+// withDefaults fills in the properties Publish always sends
+func (e Event) withDefaults() Event {
+	if e.ID == "" {
+		e.ID = newEventID()
+	}
+
+	if e.Type == "" {
+		e.Type = e.RoutingKey
+	}
+
+	if e.AppID == "" {
+		e.AppID = DefaultAppID
+	}
+
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+
+	if e.ContentType == "" {
+		e.ContentType = "text/plain"
+		if json.Valid(e.Body) {
+			e.ContentType = "application/json"
+		}
+	}
+
+	return e
+}
+
+func (e Event) publishing() amqp.Publishing {
+	p := amqp.Publishing{
+		MessageId:     e.ID,
+		Type:          e.Type,
+		AppId:         e.AppID,
+		ContentType:   e.ContentType,
+		CorrelationId: e.CorrelationID,
+		Headers:       amqp.Table(e.Headers),
+		Priority:      e.Priority,
+		Timestamp:     e.Timestamp,
+		DeliveryMode:  amqp.Persistent,
+		Body:          e.Body,
+	}
+
+	if e.Transient {
+		p.DeliveryMode = amqp.Transient
+	}
+
+	if e.Expiration > 0 {
+		p.Expiration = strconv.FormatInt(e.Expiration.Milliseconds(), 10)
+	}
+
+	switch e.Format {
+	case FormatCloudEventsBinary:
+		p = toCloudEventsBinary(e, p)
+	case FormatCloudEventsStructured:
+		p = toCloudEventsStructured(e, p)
+	}
+
+	return p
+}
+
+// eventFromDelivery reads the properties a publisher set back into an Event
+func eventFromDelivery(d amqp.Delivery) Event {
+	e := Event{
+		ID:            d.MessageId,
+		RoutingKey:    d.RoutingKey,
+		Type:          d.Type,
+		AppID:         d.AppId,
+		ContentType:   d.ContentType,
+		CorrelationID: d.CorrelationId,
+		Headers:       map[string]any(d.Headers),
+		Priority:      d.Priority,
+		Timestamp:     d.Timestamp,
+		Transient:     d.DeliveryMode != amqp.Persistent,
+		Body:          d.Body,
+	}
+
+	if ms, err := strconv.ParseInt(d.Expiration, 10, 64); err == nil {
+		e.Expiration = time.Duration(ms) * time.Millisecond
+	}
+
+	return fromCloudEvents(e)
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,88 @@
+package event
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// deliver hands back what a consumer would receive for p published with routingKey
+func deliver(p amqp.Publishing, routingKey string) amqp.Delivery {
+	return amqp.Delivery{
+		RoutingKey:    routingKey,
+		Headers:       p.Headers,
+		ContentType:   p.ContentType,
+		DeliveryMode:  p.DeliveryMode,
+		Priority:      p.Priority,
+		CorrelationId: p.CorrelationId,
+		Expiration:    p.Expiration,
+		MessageId:     p.MessageId,
+		Timestamp:     p.Timestamp,
+		Type:          p.Type,
+		AppId:         p.AppId,
+		Body:          p.Body,
+	}
+}
+
+func TestEventWithDefaults(t *testing.T) {
+	tests := []struct {
+		name            string
+		event           Event
+		wantType        string
+		wantContentType string
+	}{
+		{"json body", Event{RoutingKey: "log.INFO", Body: []byte(`{"name":"x"}`)}, "log.INFO", "application/json"},
+		{"text body", Event{RoutingKey: "log.INFO", Body: []byte("hello")}, "log.INFO", "text/plain"},
+		{"kept", Event{RoutingKey: "log.INFO", Type: LogEventType, ContentType: "text/csv", Body: []byte("a,b")}, LogEventType, "text/csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := tt.event.withDefaults()
+
+			if e.ID == "" || e.AppID != DefaultAppID || e.Timestamp.IsZero() {
+				t.Errorf("withDefaults() = %+v, want an id, app id and timestamp", e)
+			}
+
+			if e.Type != tt.wantType || e.ContentType != tt.wantContentType {
+				t.Errorf("type %q content type %q, want %q %q", e.Type, e.ContentType, tt.wantType, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestPlainEventRoundTrip(t *testing.T) {
+	sent := Event{
+		ID:            "e1",
+		RoutingKey:    "log.WARN.billing",
+		Type:          LogEventType,
+		Subject:       "invoice",
+		AppID:         "billing-service",
+		ContentType:   "application/json",
+		CorrelationID: "c1",
+		Headers:       map[string]any{"tenant": "acme"},
+		Priority:      3,
+		Expiration:    90 * time.Second,
+		Timestamp:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Transient:     true,
+		Format:        FormatPlain,
+		Body:          []byte(`{"name":"invoice"}`),
+	}
+
+	p := sent.publishing()
+	if p.Expiration != "90000" || p.DeliveryMode != amqp.Transient {
+		t.Errorf("expiration %q delivery mode %d, want 90000 and transient", p.Expiration, p.DeliveryMode)
+	}
+
+	got := eventFromDelivery(deliver(p, sent.RoutingKey))
+
+	// Plain events carry no subject outside the body
+	want := sent
+	want.Subject = ""
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v\nwant %+v", got, want)
+	}
+}
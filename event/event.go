@@ -1,28 +1,100 @@
 package event
 
 import (
+	"strings"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func declareExchange(ch *amqp.Channel) error {
-	return ch.ExchangeDeclare(
-		"logs_topic",
-		"topic",
+// declareRandomQueue declares a server-named queue from the topology's subscriber template
+func declareRandomQueue(ch *amqp.Channel) (amqp.Queue, error) {
+	return CurrentTopology().Subscriber.declare(ch, "") // pick your own name!
+}
+
+// declareDeadLetterQueue declares logs_dlx and a durable queue on it that receives
+// messages dead-lettered with name as their routing key
+func declareDeadLetterQueue(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	err := ch.ExchangeDeclare(
+		"logs_dlx",
+		"direct",
 		true,
 		false,
 		false,
 		false,
 		nil,
 	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	dead, err := ch.QueueDeclare(
+		name,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	err = ch.QueueBind(dead.Name, dead.Name, "logs_dlx", false, nil)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return dead, nil
 }
 
-func declareRandomQueue(ch *amqp.Channel) (amqp.Queue, error) {
+// declareDurableQueue declares a named queue that survives restarts. Rejected messages are
+// dead-lettered through logs_dlx to "<name>.dead", unless the topology declares the queue differently.
+func declareDurableQueue(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	// The topology wins when it has something to say about the queue
+	if spec, ok := CurrentTopology().queue(name); ok {
+		return spec.declare(ch, name)
+	}
+
+	dead, err := declareDeadLetterQueue(ch, name+".dead")
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
 	return ch.QueueDeclare(
-		"", // pick your own name!
+		name,
+		true,
 		false,
 		false,
-		true,
 		false,
-		nil,
+		amqp.Table{
+			"x-dead-letter-exchange":    "logs_dlx",
+			"x-dead-letter-routing-key": dead.Name,
+		},
 	)
-}
\ No newline at end of file
+}
+
+// MatchTopic reports whether routingKey matches an AMQP topic pattern,
+// where * stands for exactly one word and # for zero or more
+func MatchTopic(pattern, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
@@ -0,0 +1,37 @@
+package event
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		routingKey string
+		want       bool
+	}{
+		{"log.INFO", "log.INFO", true},
+		{"log.INFO", "log.WARN", false},
+		{"log.*", "log.INFO", true},
+		{"log.*", "log.INFO.billing", false},
+		{"log.*", "log", false},
+		{"log.*.billing", "log.ERROR.billing", true},
+		{"log.#", "log", true},
+		{"log.#", "log.INFO", true},
+		{"log.#", "log.INFO.billing", true},
+		{"log.#", "mail.send", false},
+		{"#", "mail.send", true},
+		{"#", "", true},
+		{"#.billing", "log.ERROR.billing", true},
+		{"#.billing", "log.ERROR.shipping", false},
+		{"log.#.billing", "log.billing", true},
+		{"*.*", "log", false},
+		{"mail.send", "mail.send.extra", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.routingKey, func(t *testing.T) {
+			if got := MatchTopic(tt.pattern, tt.routingKey); got != tt.want {
+				t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.routingKey, got, tt.want)
+			}
+		})
+	}
+}
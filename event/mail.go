@@ -0,0 +1,89 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const MailSendTopic = "mail.send"
+
+var (
+	mailServiceUrl = "http://mail-service/send"
+	// mailBackOff is the wait after the first failed attempt, doubling after each one
+	mailBackOff = 1 * time.Second
+)
+
+// MailMessage is the body of a mail.send event
+type MailMessage struct {
+	Version   int    `json:"version"`
+	MessageID string `json:"message_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Message   string `json:"message"`
+}
+
+// HandleMail delivers a mail.send event to mail-service. It retries a few times before
+// returning an error, at which point ConsumeDurable dead-letters the message.
+func HandleMail(msg Message) error {
+	var mail MailMessage
+
+	err := json.Unmarshal(msg.Body, &mail)
+	if err != nil {
+		return fmt.Errorf("unreadable mail message: %w", err)
+	}
+
+	backOff := mailBackOff
+	for attempt := 1; ; attempt++ {
+		err = sendMail(mail)
+		if err == nil {
+			return nil
+		}
+
+		if attempt == 3 {
+			return err
+		}
+
+		log.Printf("::HandleMail - attempt %d for %s failed, backing off for %d seconds: %s", attempt, mail.MessageID, int64(backOff.Seconds()), err)
+		time.Sleep(backOff)
+		backOff *= 2
+	}
+}
+
+func sendMail(mail MailMessage) error {
+	log.Printf("::sendMail - called with ID:'%s' T:'%s' S:'%s'", mail.MessageID, mail.To, mail.Subject)
+
+	jsonData, _ := json.MarshalIndent(struct {
+		From    string `json:"from"`
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+	}{mail.From, mail.To, mail.Subject, mail.Message}, "", "\t")
+
+	request, err := http.NewRequest("POST", mailServiceUrl, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	log.Printf("::sendMail - response from mail server, Code %d", response.StatusCode)
+
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("mail service returned %d", response.StatusCode)
+	}
+
+	return nil
+}
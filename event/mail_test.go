@@ -0,0 +1,63 @@
+package event
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeMailService answers with the given statuses in turn, repeating the last one
+func fakeMailService(t *testing.T, statuses ...int) *int32 {
+	t.Helper()
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&calls, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	t.Cleanup(server.Close)
+
+	url, backOff := mailServiceUrl, mailBackOff
+	mailServiceUrl, mailBackOff = server.URL, time.Millisecond
+	t.Cleanup(func() { mailServiceUrl, mailBackOff = url, backOff })
+
+	return &calls
+}
+
+func TestHandleMail(t *testing.T) {
+	body, _ := json.Marshal(MailMessage{Version: MailMessageVersion, MessageID: "m1", To: "you@example.com", Subject: "hi"})
+
+	tests := []struct {
+		name      string
+		body      []byte
+		statuses  []int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"delivered", body, []int{http.StatusAccepted}, false, 1},
+		{"delivered on a retry", body, []int{http.StatusBadGateway, http.StatusAccepted}, false, 2},
+		{"gives up so it is dead-lettered", body, []int{http.StatusBadGateway}, true, 3},
+		{"unreadable", []byte("not json"), []int{http.StatusAccepted}, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := fakeMailService(t, tt.statuses...)
+
+			err := HandleMail(Message{Event: Event{RoutingKey: MailSendTopic, Body: tt.body}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("HandleMail() = %v, want error %v", err, tt.wantErr)
+			}
+
+			if got := atomic.LoadInt32(calls); got != tt.wantCalls {
+				t.Errorf("mail-service was called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
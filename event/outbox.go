@@ -0,0 +1,251 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Outbox is a directory of events waiting to be published, one file each, so that they
+// survive RabbitMQ being down and the process restarting. Relay publishes them in order
+// and removes each file once RabbitMQ has confirmed it.
+type Outbox struct {
+	dir   string
+	depth int64
+	wake  chan struct{}
+	// downSince is when the relay lost its channel to RabbitMQ in unix nanoseconds, zero while it has one
+	downSince int64
+}
+
+func OpenOutbox(dir string) (*Outbox, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:       dir,
+		wake:      make(chan struct{}, 1),
+		downSince: time.Now().UnixNano(),
+	}
+
+	pending, err := o.pending()
+	if err != nil {
+		return nil, err
+	}
+	o.depth = int64(len(pending))
+
+	return o, nil
+}
+
+// Depth is how many events are waiting to be published
+func (o *Outbox) Depth() int64 {
+	return atomic.LoadInt64(&o.depth)
+}
+
+// Stalled is how long the relay has been without a channel to RabbitMQ, zero while it can publish
+func (o *Outbox) Stalled() time.Duration {
+	since := atomic.LoadInt64(&o.downSince)
+	if since == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, since))
+}
+
+// Add stores e until the relay has published it
+func (o *Outbox) Add(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Names sort in the order events were added
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), e.ID)
+
+	// Write then rename so the relay never sees a half written event
+	tmp, err := os.CreateTemp(o.dir, ".outbox-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(o.dir, name))
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&o.depth, 1)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (o *Outbox) pending() ([]string, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Relay publishes the outbox over rabbit until ctx is cancelled, starting again on each new
+// connection and backing off while publishing fails
+func (o *Outbox) Relay(ctx context.Context, rabbit *Connection) {
+	backOff := time.Second
+
+	for {
+		conn, err := rabbit.Wait(ctx)
+		if err != nil {
+			return
+		}
+
+		sent, err := o.relayConnection(ctx, conn)
+		atomic.CompareAndSwapInt64(&o.downSince, 0, time.Now().UnixNano())
+		if ctx.Err() != nil {
+			return
+		}
+
+		if sent > 0 {
+			backOff = time.Second
+		}
+
+		log.Printf("::Relay - %s, %d events waiting, retrying in %s", err, o.Depth(), backOff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backOff):
+		}
+
+		backOff *= 2
+		if backOff > 30*time.Second {
+			backOff = 30 * time.Second
+		}
+	}
+}
+
+// relayConnection publishes with confirms over one connection, returning how many events it sent when that fails
+func (o *Outbox) relayConnection(ctx context.Context, conn *amqp.Connection) (int, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	err = ch.Confirm(false)
+	if err != nil {
+		return 0, err
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	atomic.StoreInt64(&o.downSince, 0)
+
+	publish := func(ctx context.Context, e Event) error {
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, "logs_topic", e.RoutingKey, false, false, e.publishing())
+		if err != nil {
+			return err
+		}
+
+		if !confirmation.Wait() {
+			return errors.New("RabbitMQ did not confirm " + e.ID)
+		}
+
+		return nil
+	}
+
+	sent := 0
+	for {
+		n, err := o.drain(ctx, publish)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		case err := <-closed:
+			return sent, fmt.Errorf("channel closed: %v", err)
+		case <-o.wake:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// drain publishes everything pending, one at a time so the order is kept. publish returns once
+// RabbitMQ has confirmed the event, which is only then removed.
+func (o *Outbox) drain(ctx context.Context, publish func(ctx context.Context, e Event) error) (int, error) {
+	names, err := o.pending()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, name := range names {
+		path := filepath.Join(o.dir, name)
+
+		var e Event
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err != nil {
+			// Set it aside rather than block everything behind it
+			log.Printf("::drain - setting aside unreadable outbox entry %s: %s", name, err)
+			_ = os.Rename(path, path+".bad")
+			atomic.AddInt64(&o.depth, -1)
+			continue
+		}
+
+		err = publish(ctx, e)
+		if err != nil {
+			return sent, err
+		}
+
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return sent, err
+		}
+
+		atomic.AddInt64(&o.depth, -1)
+		sent++
+	}
+
+	return sent, nil
+}
@@ -1,6 +1,7 @@
 package event
 
 import (
+	"context"
 	"log"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -8,11 +9,16 @@ import (
 
 type Emmitter struct {
 	connection *amqp.Connection
+	// Format is used for events that don't set their own, plain unless changed
+	Format Format
+	// Outbox, when set, takes events instead of RabbitMQ and its relay publishes them
+	Outbox *Outbox
 }
 
 func NewEmitter(conn *amqp.Connection) (Emmitter, error) {
 	emmitter := Emmitter{
 		connection: conn,
+		Format:     FormatPlain,
 	}
 	
 	err := emmitter.setup()
@@ -23,39 +29,45 @@ func NewEmitter(conn *amqp.Connection) (Emmitter, error) {
 	return emmitter, nil
 }
 
+// setup makes sure the topology has been applied to the connection
 func (e *Emmitter) setup() error {
-	channel, err := e.connection.Channel()
-	if err != nil {
-		return err
-	}
-	defer channel.Close()
-	
-	return declareExchange(channel)
+	_, err := ApplyTopology(e.connection)
+	return err
 }
 
+// Push publishes a plain event on logs_topic with severity as its routing key
 func (e *Emmitter) Push(event string, severity string) error {
+	return e.Publish(context.Background(), Event{
+		RoutingKey: severity,
+		Body:       []byte(event),
+	})
+}
+
+// Publish sends e to logs_topic, filling in the message ID, timestamp, app ID and content type if they are empty
+func (e *Emmitter) Publish(ctx context.Context, event Event) error {
+	if event.Format == "" {
+		event.Format = e.Format
+	}
+	event = event.withDefaults()
+
+	if e.Outbox != nil {
+		return e.Outbox.Add(event)
+	}
+
 	channel, err := e.connection.Channel()
 	if err != nil {
 		return err
 	}
 	defer channel.Close()
 
-	log.Println("Pushing to channel")
+	log.Printf("Pushing %s to channel as %s", event.ID, event.RoutingKey)
 
-	err = channel.Publish(
+	return channel.PublishWithContext(
+		ctx,
 		"logs_topic",
-		severity,
+		event.RoutingKey,
 		false,
 		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body: []byte(event),
-		},
+		event.publishing(),
 	)
-	
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,175 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownVersion is returned for events newer than, or otherwise unreachable from, the registered version
+var ErrUnknownVersion = errors.New("unknown event schema version")
+
+// Upcaster rewrites the fields of an event from one schema version to the next, in place
+type Upcaster func(fields map[string]json.RawMessage) error
+
+type schema struct {
+	eventType string
+	current   int
+	// topics find the schema for events published without a type
+	topics    []string
+	upcasters map[int]Upcaster
+}
+
+// Registry knows the current schema version of each event type and how to bring older versions up to it.
+// Versions travel in the body's "version" field, events without one are version 0.
+type Registry struct {
+	mu      sync.RWMutex
+	schemas map[string]*schema
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		schemas: map[string]*schema{},
+	}
+}
+
+// Register records eventType at version current. Events without a type whose routing key
+// matches one of topics are treated as eventType as well.
+func (r *Registry) Register(eventType string, current int, topics ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.schemas[eventType] = &schema{
+		eventType: eventType,
+		current:   current,
+		topics:    topics,
+		upcasters: map[int]Upcaster{},
+	}
+}
+
+// RegisterUpcaster adds the step from version from to from+1 of eventType
+func (r *Registry) RegisterUpcaster(eventType string, from int, up Upcaster) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.schemas[eventType]
+	if !ok {
+		return fmt.Errorf("event type %q is not registered", eventType)
+	}
+
+	if from < 0 || from >= s.current {
+		return fmt.Errorf("%s upcaster from version %d is outside 0..%d", eventType, from, s.current-1)
+	}
+
+	s.upcasters[from] = up
+
+	return nil
+}
+
+func (r *Registry) lookup(e Event) *schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if s, ok := r.schemas[e.Type]; ok {
+		return s
+	}
+
+	for _, s := range r.schemas {
+		for _, topic := range s.topics {
+			if MatchTopic(topic, e.RoutingKey) {
+				return s
+			}
+		}
+	}
+
+	return nil
+}
+
+// Upcast returns e with its body at the current version of its type. Events of types the
+// registry doesn't know are returned unchanged.
+func (r *Registry) Upcast(e Event) (Event, error) {
+	s := r.lookup(e)
+	if s == nil {
+		return e, nil
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(e.Body, &fields)
+	if err != nil {
+		return e, fmt.Errorf("%s event is not a JSON object: %w", s.eventType, err)
+	}
+
+	version := 0
+	if raw, ok := fields["version"]; ok {
+		err = json.Unmarshal(raw, &version)
+		if err != nil {
+			return e, fmt.Errorf("%s event has an unreadable version: %w", s.eventType, err)
+		}
+	}
+
+	if version == s.current {
+		return e, nil
+	}
+
+	if version < 0 || version > s.current {
+		return e, fmt.Errorf("%w: %s version %d, current is %d", ErrUnknownVersion, s.eventType, version, s.current)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for ; version < s.current; version++ {
+		up, ok := s.upcasters[version]
+		if !ok {
+			return e, fmt.Errorf("%w: no upcaster for %s version %d", ErrUnknownVersion, s.eventType, version)
+		}
+
+		err = up(fields)
+		if err != nil {
+			return e, fmt.Errorf("upcasting %s from version %d: %w", s.eventType, version, err)
+		}
+	}
+
+	fields["version"], _ = json.Marshal(s.current)
+
+	e.Body, err = json.Marshal(fields)
+	if err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+const (
+	LogEventType       = "broker.log"
+	PayloadVersion     = 2
+	MailMessageVersion = 1
+)
+
+// Schemas is the registry consumers use unless given another
+var Schemas = defaultRegistry()
+
+func defaultRegistry() *Registry {
+	r := NewRegistry()
+
+	// Version 1 only added the version field, so older events need nothing else
+	addVersion := func(fields map[string]json.RawMessage) error {
+		return nil
+	}
+
+	r.Register(LogEventType, PayloadVersion, "log.#")
+	_ = r.RegisterUpcaster(LogEventType, 0, addVersion)
+	// Version 2 added severity and category, everything before was published as log.INFO
+	_ = r.RegisterUpcaster(LogEventType, 1, func(fields map[string]json.RawMessage) error {
+		if _, ok := fields["severity"]; !ok {
+			fields["severity"] = json.RawMessage(`"INFO"`)
+		}
+		return nil
+	})
+
+	r.Register(MailSendTopic, MailMessageVersion, MailSendTopic)
+	_ = r.RegisterUpcaster(MailSendTopic, 0, addVersion)
+
+	return r
+}
@@ -0,0 +1,142 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultRegistryUpcast(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      Event
+		wantFields map[string]any
+		wantErr    error
+	}{
+		{
+			name:       "log v0 by type",
+			event:      Event{Type: LogEventType, Body: []byte(`{"name":"x","data":"y"}`)},
+			wantFields: map[string]any{"version": 2.0, "name": "x", "data": "y", "severity": "INFO"},
+		},
+		{
+			name:       "log v1 by topic",
+			event:      Event{RoutingKey: "log.INFO", Type: "log.INFO", Body: []byte(`{"version":1,"name":"x"}`)},
+			wantFields: map[string]any{"version": 2.0, "name": "x", "severity": "INFO"},
+		},
+		{
+			name:       "log v1 keeps its severity",
+			event:      Event{Type: LogEventType, Body: []byte(`{"version":1,"name":"x","severity":"ERROR"}`)},
+			wantFields: map[string]any{"version": 2.0, "name": "x", "severity": "ERROR"},
+		},
+		{
+			name:       "log v2 is current",
+			event:      Event{Type: LogEventType, Body: []byte(`{"version":2,"name":"x","severity":"WARN","category":"billing"}`)},
+			wantFields: map[string]any{"version": 2.0, "name": "x", "severity": "WARN", "category": "billing"},
+		},
+		{
+			name:       "mail v0",
+			event:      Event{RoutingKey: MailSendTopic, Body: []byte(`{"to":"you@example.com"}`)},
+			wantFields: map[string]any{"version": 1.0, "to": "you@example.com"},
+		},
+		{
+			name:       "unknown type is left alone",
+			event:      Event{Type: "other", RoutingKey: "other.thing", Body: []byte(`{"version":9}`)},
+			wantFields: map[string]any{"version": 9.0},
+		},
+		{
+			name:    "newer than current",
+			event:   Event{Type: LogEventType, Body: []byte(`{"version":3}`)},
+			wantErr: ErrUnknownVersion,
+		},
+		{
+			name:    "negative version",
+			event:   Event{Type: LogEventType, Body: []byte(`{"version":-1}`)},
+			wantErr: ErrUnknownVersion,
+		},
+		{
+			name:    "not an object",
+			event:   Event{Type: LogEventType, Body: []byte(`"text"`)},
+			wantErr: errors.New("any"),
+		},
+		{
+			name:    "unreadable version",
+			event:   Event{Type: LogEventType, Body: []byte(`{"version":"two"}`)},
+			wantErr: errors.New("any"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := defaultRegistry().Upcast(tt.event)
+
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("Upcast() = %s, want an error", got.Body)
+				}
+				if errors.Is(tt.wantErr, ErrUnknownVersion) && !errors.Is(err, ErrUnknownVersion) {
+					t.Errorf("Upcast() = %v, want ErrUnknownVersion", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fields map[string]any
+			if err := json.Unmarshal(got.Body, &fields); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("Upcast() = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestRegistryUpcasterChain(t *testing.T) {
+	r := NewRegistry()
+	r.Register("thing", 2)
+
+	if err := r.RegisterUpcaster("thing", 2, nil); err == nil {
+		t.Error("an upcaster from the current version should be refused")
+	}
+	if err := r.RegisterUpcaster("other", 0, nil); err == nil {
+		t.Error("an upcaster for an unregistered type should be refused")
+	}
+
+	_ = r.RegisterUpcaster("thing", 0, func(fields map[string]json.RawMessage) error {
+		fields["first"] = json.RawMessage(`true`)
+		return nil
+	})
+
+	// The step from 1 to 2 is missing
+	_, err := r.Upcast(Event{Type: "thing", Body: []byte(`{}`)})
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Upcast() = %v, want ErrUnknownVersion for the missing step", err)
+	}
+
+	_ = r.RegisterUpcaster("thing", 1, func(fields map[string]json.RawMessage) error {
+		if _, ok := fields["first"]; !ok {
+			return errors.New("ran before the first step")
+		}
+		fields["second"] = json.RawMessage(`true`)
+		return nil
+	})
+
+	got, err := r.Upcast(Event{Type: "thing", Body: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Body) != `{"first":true,"second":true,"version":2}` {
+		t.Errorf("Upcast() = %s, want both steps applied in order", got.Body)
+	}
+
+	_ = r.RegisterUpcaster("thing", 1, func(fields map[string]json.RawMessage) error {
+		return errors.New("cannot")
+	})
+	if _, err := r.Upcast(Event{Type: "thing", Body: []byte(`{"version":1}`)}); err == nil {
+		t.Error("a failing upcaster should fail Upcast")
+	}
+}
@@ -0,0 +1,378 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology is the set of exchanges, queues and bindings the broker expects RabbitMQ to have
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges"`
+	Queues    []QueueSpec    `json:"queues"`
+	Bindings  []BindingSpec  `json:"bindings"`
+	// Subscriber is the template for the queue Consume declares for itself, its name is ignored.
+	// It must be exclusive or auto-delete so the queue goes away with its consumer.
+	Subscriber QueueSpec `json:"subscriber"`
+}
+
+type ExchangeSpec struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Durable    bool   `json:"durable"`
+	AutoDelete bool   `json:"auto_delete"`
+	Internal   bool   `json:"internal"`
+}
+
+type QueueSpec struct {
+	Name string `json:"name"`
+	// Type is "classic" or "quorum", quorum queues must be durable and can't be exclusive or auto-delete
+	Type                 string `json:"type"`
+	Durable              bool   `json:"durable"`
+	AutoDelete           bool   `json:"auto_delete"`
+	Exclusive            bool   `json:"exclusive"`
+	DeadLetterExchange   string `json:"dead_letter_exchange,omitempty"`
+	DeadLetterRoutingKey string `json:"dead_letter_routing_key,omitempty"`
+	MessageTTL           string `json:"message_ttl,omitempty"`
+	MaxLength            int64  `json:"max_length,omitempty"`
+	MaxLengthBytes       int64  `json:"max_length_bytes,omitempty"`
+}
+
+type BindingSpec struct {
+	Exchange   string `json:"exchange"`
+	Queue      string `json:"queue"`
+	RoutingKey string `json:"routing_key"`
+}
+
+// Drift is something on the broker that is missing or has different settings to the topology
+type Drift struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+}
+
+// DefaultTopology is what the broker has always declared
+func DefaultTopology() Topology {
+	return Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: "logs_topic", Kind: "topic", Durable: true},
+			{Name: "logs_dlx", Kind: "direct", Durable: true},
+		},
+		Subscriber: QueueSpec{Exclusive: true},
+	}
+}
+
+// LoadTopology reads a topology file, an empty path gives DefaultTopology
+func LoadTopology(path string) (Topology, error) {
+	if path == "" {
+		return DefaultTopology(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, err
+	}
+
+	var t Topology
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return Topology{}, fmt.Errorf("topology %s: %w", path, err)
+	}
+
+	return t, t.Validate()
+}
+
+func (t Topology) Validate() error {
+	exchanges := map[string]bool{}
+	for _, e := range t.Exchanges {
+		switch e.Kind {
+		case "direct", "fanout", "topic", "headers":
+		default:
+			return fmt.Errorf("exchange %q: unknown kind %q", e.Name, e.Kind)
+		}
+		if e.Name == "" {
+			return errors.New("exchanges need a name")
+		}
+		exchanges[e.Name] = true
+	}
+
+	if !exchanges["logs_topic"] {
+		return errors.New("the topology must declare the logs_topic exchange")
+	}
+
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return errors.New("queues need a name, only the subscriber template is named by the server")
+		}
+		if _, err := q.args(); err != nil {
+			return err
+		}
+		queues[q.Name] = true
+	}
+
+	if t.Subscriber.Type == "quorum" {
+		return errors.New("the subscriber queue can't be a quorum queue")
+	}
+	if !t.Subscriber.Exclusive && !t.Subscriber.AutoDelete {
+		return errors.New("the subscriber queue must be exclusive or auto-delete, or every Consume leaves a queue behind")
+	}
+	if _, err := t.Subscriber.args(); err != nil {
+		return err
+	}
+
+	for _, b := range t.Bindings {
+		if !exchanges[b.Exchange] || !queues[b.Queue] {
+			return fmt.Errorf("binding %s -> %s must refer to a declared exchange and queue", b.Exchange, b.Queue)
+		}
+	}
+
+	return nil
+}
+
+// args builds the x- arguments for the queue
+func (q QueueSpec) args() (amqp.Table, error) {
+	args := amqp.Table{}
+
+	switch q.Type {
+	case "", "classic":
+	case "quorum":
+		if !q.Durable || q.Exclusive || q.AutoDelete {
+			return nil, fmt.Errorf("queue %q: quorum queues must be durable and can't be exclusive or auto-delete", q.Name)
+		}
+		args["x-queue-type"] = "quorum"
+	default:
+		return nil, fmt.Errorf("queue %q: unknown type %q", q.Name, q.Type)
+	}
+
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+
+	if q.MessageTTL != "" {
+		ttl, err := time.ParseDuration(q.MessageTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("queue %q: invalid message_ttl %q", q.Name, q.MessageTTL)
+		}
+		args["x-message-ttl"] = ttl.Milliseconds()
+	}
+
+	if q.MaxLength < 0 || q.MaxLengthBytes < 0 {
+		return nil, fmt.Errorf("queue %q: max lengths can't be negative", q.Name)
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	if q.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = q.MaxLengthBytes
+	}
+
+	return args, nil
+}
+
+func (q QueueSpec) declare(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	args, err := q.args()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return ch.QueueDeclare(name, q.Durable, q.AutoDelete, q.Exclusive, false, args)
+}
+
+func (t Topology) queue(name string) (QueueSpec, bool) {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+
+	return QueueSpec{}, false
+}
+
+// Apply declares everything in the topology. Declaring what already exists is a no-op, so it is
+// safe to run at every startup. Anything that exists with different settings is returned as drift
+// and left alone, RabbitMQ can't change it in place.
+func (t Topology) Apply(conn *amqp.Connection) ([]Drift, error) {
+	var drifts []Drift
+
+	// A failed declaration closes its channel, so each gets a fresh one
+	declare := func(kind, name string, fn func(ch *amqp.Channel) error) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+
+		err = fn(ch)
+
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+			drifts = append(drifts, Drift{Kind: kind, Name: name, Detail: amqpErr.Reason})
+			return nil
+		}
+
+		return err
+	}
+
+	for _, e := range t.Exchanges {
+		err := declare("exchange", e.Name, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, nil)
+		})
+		if err != nil {
+			return drifts, fmt.Errorf("declaring exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		err := declare("queue", q.Name, func(ch *amqp.Channel) error {
+			_, err := q.declare(ch, q.Name)
+			return err
+		})
+		if err != nil {
+			return drifts, fmt.Errorf("declaring queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		err := declare("binding", b.Exchange+" -> "+b.Queue, func(ch *amqp.Channel) error {
+			return ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, nil)
+		})
+		if err != nil {
+			return drifts, fmt.Errorf("binding %s to %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+
+	return drifts, nil
+}
+
+// Check compares the broker with the topology without creating anything. Missing exchanges and queues are
+// reported as drift. Those that exist are declared again with the topology's settings, which changes nothing
+// when they match and reports drift when they don't. Bindings can't be looked up over AMQP without creating
+// them, so they aren't checked.
+func (t Topology) Check(conn *amqp.Connection) ([]Drift, error) {
+	var drifts []Drift
+
+	// A failed declaration closes its channel, so each check gets a fresh one
+	check := func(kind, name string, passive, declare func(ch *amqp.Channel) error) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+
+		err = passive(ch)
+
+		// Once it is known to exist, declaring it again with our settings changes nothing,
+		// but fails if the settings differ
+		if err == nil {
+			err = declare(ch)
+		}
+
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) {
+			switch amqpErr.Code {
+			case amqp.NotFound:
+				drifts = append(drifts, Drift{Kind: kind, Name: name, Detail: "missing"})
+				return nil
+			case amqp.PreconditionFailed, amqp.ResourceLocked:
+				drifts = append(drifts, Drift{Kind: kind, Name: name, Detail: amqpErr.Reason})
+				return nil
+			}
+		}
+
+		return err
+	}
+
+	for _, e := range t.Exchanges {
+		err := check("exchange", e.Name, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclarePassive(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, nil)
+		}, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, nil)
+		})
+		if err != nil {
+			return drifts, fmt.Errorf("checking exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		err := check("queue", q.Name, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, nil)
+			return err
+		}, func(ch *amqp.Channel) error {
+			_, err := q.declare(ch, q.Name)
+			return err
+		})
+		if err != nil {
+			return drifts, fmt.Errorf("checking queue %s: %w", q.Name, err)
+		}
+	}
+
+	return drifts, nil
+}
+
+var (
+	topologyMu sync.Mutex
+	topology   = DefaultTopology()
+	// applied remembers the open connections the topology has been applied to and the drift found
+	applied = map[*amqp.Connection][]Drift{}
+)
+
+// SetTopology replaces the topology Emmitter and Consumer apply, call it before creating either
+func SetTopology(t Topology) {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	topology = t
+	applied = map[*amqp.Connection][]Drift{}
+}
+
+func CurrentTopology() Topology {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	return topology
+}
+
+// ApplyTopology applies the current topology once per connection, logging any drift,
+// and returns the drift found
+func ApplyTopology(conn *amqp.Connection) ([]Drift, error) {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	if drifts, ok := applied[conn]; ok {
+		return drifts, nil
+	}
+
+	drifts, err := topology.Apply(conn)
+	if err != nil {
+		return drifts, err
+	}
+
+	for _, d := range drifts {
+		log.Printf("::ApplyTopology - %s %s differs from the topology: %s", d.Kind, d.Name, d.Detail)
+	}
+
+	applied[conn] = drifts
+
+	// Forget the connection once it closes, a reconnect brings a new one
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closed
+
+		topologyMu.Lock()
+		defer topologyMu.Unlock()
+
+		delete(applied, conn)
+	}()
+
+	return drifts, nil
+}
@@ -0,0 +1,63 @@
+package event
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTopologyValidate(t *testing.T) {
+	withSubscriber := func(q QueueSpec) Topology {
+		t := DefaultTopology()
+		t.Subscriber = q
+		return t
+	}
+
+	withQueue := func(q QueueSpec, bindings ...BindingSpec) Topology {
+		t := DefaultTopology()
+		t.Queues = []QueueSpec{q}
+		t.Bindings = bindings
+		return t
+	}
+
+	tests := []struct {
+		name     string
+		topology Topology
+		wantErr  bool
+	}{
+		{"default", DefaultTopology(), false},
+		{"no logs_topic", Topology{Exchanges: []ExchangeSpec{{Name: "other", Kind: "topic"}}, Subscriber: QueueSpec{Exclusive: true}}, true},
+		{"unknown exchange kind", Topology{Exchanges: []ExchangeSpec{{Name: "logs_topic", Kind: "weird"}}, Subscriber: QueueSpec{Exclusive: true}}, true},
+		{"auto-delete subscriber", withSubscriber(QueueSpec{AutoDelete: true, MessageTTL: "1m"}), false},
+		{"subscriber left behind", withSubscriber(QueueSpec{MessageTTL: "1m"}), true},
+		{"quorum subscriber", withSubscriber(QueueSpec{Type: "quorum", Exclusive: true}), true},
+		{"bad subscriber ttl", withSubscriber(QueueSpec{Exclusive: true, MessageTTL: "soon"}), true},
+		{"quorum queue", withQueue(QueueSpec{Name: "audit", Type: "quorum", Durable: true}), false},
+		{"transient quorum queue", withQueue(QueueSpec{Name: "audit", Type: "quorum"}), true},
+		{"unnamed queue", withQueue(QueueSpec{Durable: true}), true},
+		{"negative max length", withQueue(QueueSpec{Name: "audit", MaxLength: -1}), true},
+		{"binding", withQueue(QueueSpec{Name: "audit"}, BindingSpec{Exchange: "logs_topic", Queue: "audit", RoutingKey: "#"}), false},
+		{"binding to an undeclared queue", withQueue(QueueSpec{Name: "audit"}, BindingSpec{Exchange: "logs_topic", Queue: "other"}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.topology.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadTopologyChecksTheSubscriber(t *testing.T) {
+	// A file that only sets a TTL on the subscriber would otherwise drop the default's exclusive flag
+	path := filepath.Join(t.TempDir(), "topology.json")
+	data := `{"exchanges":[{"name":"logs_topic","kind":"topic","durable":true}],"subscriber":{"message_ttl":"1m"}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadTopology(path); err == nil {
+		t.Error("LoadTopology() should refuse a subscriber that is neither exclusive nor auto-delete")
+	}
+}